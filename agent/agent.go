@@ -1,7 +1,11 @@
 package agent
 
 import (
+	"agent/protocol"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ed25519"
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
@@ -9,9 +13,12 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"runtime"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
 )
 
 const (
@@ -26,30 +33,99 @@ type AgentArguments struct {
 	ScriptInvterval int
 
 	ServerURL string
+
+	// ConfigFileName is the agent config file, relative to WorkingDir
+	ConfigFileName string
+	// Overrides are set by flags or env explicitly, they take precedence over the config file
+	Overrides AgentConfig
 }
 
 type Agent struct {
 	agentVersion string
 
-	args *AgentArguments
+	// baseArgs are the arguments from command line, args are merged with config file
+	baseArgs *AgentArguments
+	args     *AgentArguments
+
+	config        *AgentConfig
+	configModTime time.Time
+	// last config pushed by server, the ignored fields are warned once
+	pushedConfig json.RawMessage
+
+	devInfo    *DevInfo
+	script     *Script
+	reconciler *Reconciler
+	httpClient *HTTPClient
+	resolver   *Resolver
+	host       *scriptHost
 
-	devInfo *DevInfo
-	script  *Script
+	// named scripts run beside the main script, only touched by Run
+	plugins         map[string]*plugin
+	pluginChan      chan struct{}
+	reportedPlugins string
 
 	scriptFileMD5     string
 	scriptFileContent []byte
+
+	// update deferred by the running script and the md5 rejected by it
+	pendingUpdate      *pendingUpdate
+	rejectedUpdateMD5  string
+	rejectedUpdateTime time.Time
+
+	reportedManifestVersion string
+
+	pendingUpgrade *upgradeState
+	enrollment     *enrollmentState
+	deviceKey      ed25519.PrivateKey
+
+	lastUpdateErr     string
+	lastUpdateErrTime time.Time
+
+	// md5 of the last known good script and the script unloaded by watchdog
+	goodScriptMD5 string
+	scriptFault   *ScriptFault
+
+	// etag and body of the last update config, for conditional request
+	updateConfigETag   string
+	updateConfigBody   []byte
+	pollFailures       int
+	serverPollInterval time.Duration
+
+	endpoints *endpointList
+
+	reloadChan chan struct{}
+	dumpChan   chan struct{}
 }
 
 type UpdateConfig struct {
 	MD5 string `json:"md5"`
 	URL string `json:"url"`
+
+	Signature string `json:"signature,omitempty"`
+
+	// all plugins of the device, the installed ones not in it are removed
+	Plugins []*PluginFile `json:"plugins,omitempty"`
+
+	Manifest *Manifest     `json:"manifest,omitempty"`
+	Agent    *AgentRelease `json:"agent,omitempty"`
+	// decoded as PushedConfig, see updateConfigFile
+	Config json.RawMessage `json:"config,omitempty"`
+
+	Enrollment *protocol.Enrollment `json:"enrollment,omitempty"`
+
+	// server hint for the next check in, 0 use the local interval
+	NextPollSeconds int `json:"nextPollSeconds,omitempty"`
 }
 
 func New(args *AgentArguments) (*Agent, error) {
 	agent := &Agent{
 		agentVersion: version,
-		args:         args,
+		baseArgs:     args,
 		devInfo:      GetDevInfo(),
+		reloadChan:   make(chan struct{}, 1),
+		dumpChan:     make(chan struct{}, 1),
+		plugins:      make(map[string]*plugin),
+		pluginChan:   make(chan struct{}, 1),
 	}
 
 	err := os.MkdirAll(args.WorkingDir, os.ModePerm)
@@ -57,6 +133,36 @@ func New(args *AgentArguments) (*Agent, error) {
 		return nil, err
 	}
 
+	err = agent.loadEnrollment()
+	if err != nil {
+		return nil, err
+	}
+
+	agent.deviceKey, err = loadDeviceKey(args.WorkingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	agent.resolver = newResolver(args.WorkingDir)
+	agent.httpClient = newHTTPClient(agent.resolver)
+	agent.httpClient.signer = agent.signRequest
+	agent.host = &scriptHost{
+		workingDir:    args.WorkingDir,
+		version:       agent.agentVersion,
+		devInfo:       agent.devInfo,
+		httpClient:    agent.httpClient,
+		resolver:      agent.resolver,
+		notifyPlugins: agent.notifyPlugins,
+	}
+
+	_, err = agent.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	agent.reconciler = newReconciler(args.WorkingDir, agent.httpClient)
+	agent.loadWatchdogState()
+
 	return agent, nil
 }
 
@@ -64,35 +170,97 @@ func (a *Agent) Version() string {
 	return a.agentVersion
 }
 
+// Reload ask Run to reload the script from disk without stopping the processes
+func (a *Agent) Reload() {
+	select {
+	case a.reloadChan <- struct{}{}:
+	default:
+	}
+}
+
+// DumpState ask Run to write the agent state to log and working dir
+func (a *Agent) DumpState() {
+	select {
+	case a.dumpChan <- struct{}{}:
+	default:
+	}
+}
+
 func (a *Agent) Run(ctx context.Context) error {
+	a.checkUpgrade()
 	a.loadLocal()
+	a.loadPlugins()
 	a.updateScriptFromServer()
 	a.renewScript()
+	a.reconcile()
 
-	scriptUpdateinterval := time.Second * time.Duration(a.args.ScriptInvterval)
-	ticker := time.NewTicker(scriptUpdateinterval)
-	scriptUpdateTime := time.Now()
+	pollTimer := time.NewTimer(a.nextPollInterval())
 	loop := true
-	defer ticker.Stop()
+	defer pollTimer.Stop()
+
+	upgradeDeadline := a.upgradeDeadline()
+
+	configTicker := time.NewTicker(configCheckInterval)
+	defer configTicker.Stop()
+
+	heartbeat := a.heartbeatTimer()
+	// heartbeat may be enabled by config reload
+	applyIntervals := func() {
+		if heartbeat == nil {
+			heartbeat = a.heartbeatTimer()
+		}
+	}
 
 	for loop {
+		a.checkWatchdog()
+		a.checkPendingUpdate(false)
+
 		script := a.currentScript()
 		select {
 		case ev := <-script.events():
 			script.handleEvent(ev)
-		case <-ticker.C:
-			elapsed := time.Since(scriptUpdateTime)
-			if elapsed > scriptUpdateinterval {
-				a.updateScriptFromServer()
+		case <-pollTimer.C:
+			a.updateScriptFromServer()
 
-				if a.scriptFileMD5 != script.fileMD5 {
-					a.renewScript()
-				}
+			if a.scriptFileMD5 != script.fileMD5 {
+				a.renewScript()
+			}
 
-				scriptUpdateTime = time.Now()
+			a.reconcile()
+			a.currentScript().checkMemory()
+			a.markScriptGood()
+			a.cleanBundles()
+
+			pollTimer.Reset(a.nextPollInterval())
+		case <-configTicker.C:
+			a.checkConfigFile()
+			applyIntervals()
+		case <-heartbeat:
+			a.heartbeat()
+			heartbeat = a.heartbeatTimer()
+		case <-a.reloadChan:
+			if _, err := a.loadConfig(); err != nil {
+				log.Errorf("reload config failed:%v", err)
+			}
+			a.reload()
+			applyIntervals()
+		case <-a.dumpChan:
+			a.dumpState()
+		case <-a.pluginChan:
+			a.reportPlugins()
+		case job := <-a.reconciler.done:
+			a.finishReconcile(job)
+		case <-a.pendingDeadline():
+			a.checkPendingUpdate(true)
+		case <-upgradeDeadline:
+			if a.pendingUpgrade != nil {
+				a.rollbackUpgrade(a.pendingUpgrade)
 			}
 		case <-ctx.Done():
+			a.persistScriptState()
 			script.stop()
+			a.stopPlugins(true)
+			a.reconciler.stop()
 			log.Info("ctx done, Run() will quit")
 			loop = false
 		}
@@ -105,49 +273,207 @@ func (a *Agent) updateScriptFromServer() {
 	log.Info("updateScriptFromServer")
 	updateConfig, err := a.getUpdateConfigFromServer()
 	if err != nil {
+		a.pollFailures++
+		a.setUpdateErr(err)
 		log.Errorf("updateScriptFromServer get update config: %s", err.Error())
 		return
 	}
 
+	a.pollFailures = 0
+	a.serverPollInterval = time.Second * time.Duration(updateConfig.NextPollSeconds)
+
+	a.confirmUpgrade()
+
+	// server without enrollment does not return it
+	if updateConfig.Enrollment != nil {
+		a.setEnrollment(updateConfig.Enrollment)
+		if !a.isEnrolled() {
+			log.Infof("device not enrolled, status %s", a.enrollment.Status)
+			return
+		}
+	}
+
+	a.uploadCrashLog()
+
+	if updateConfig.Agent != nil {
+		a.upgradeAgent(updateConfig.Agent)
+	}
+
+	if updateConfig.Config != nil {
+		a.updateConfigFile(updateConfig.Config)
+	}
+
+	if updateConfig.Manifest != nil {
+		a.reconciler.setManifest(updateConfig.Manifest)
+	}
+
+	a.updatePlugins(updateConfig.Plugins)
+
+	if len(updateConfig.MD5) == 0 {
+		return
+	}
+
 	if a.scriptFileMD5 == updateConfig.MD5 {
+		a.dropPendingUpdate()
+		return
+	}
+
+	if a.isRejectedUpdate(updateConfig.MD5) {
+		log.Debugf("script %s is rejected by the running script", updateConfig.MD5)
+		return
+	}
+
+	if a.pendingUpdate != nil && a.pendingUpdate.md5 == updateConfig.MD5 {
+		return
+	}
+
+	if a.isFaultedScript(updateConfig.MD5) {
+		log.Infof("script %s is faulted, wait for a new script", updateConfig.MD5)
 		return
 	}
 
 	buf, err := a.getScriptFromServer(updateConfig.URL)
 	if err != nil {
+		a.setUpdateErr(err)
 		log.Errorf("updateScriptFromServer get script:%s", err.Error())
 		return
 	}
 
 	newFileMD5 := fmt.Sprintf("%x", md5.Sum(buf))
 	if newFileMD5 != updateConfig.MD5 {
+		a.setUpdateErr(fmt.Errorf("server script file md5 not match"))
 		log.Errorf("Server script file md5 not match")
 		return
 	}
 
-	a.scriptFileContent = buf
-	a.scriptFileMD5 = updateConfig.MD5
-	a.updateScriptFile(buf)
+	err = a.config.verifyScript(buf, updateConfig.Signature)
+	if err != nil {
+		a.setUpdateErr(err)
+		log.Errorf("updateScriptFromServer verify script:%s", err.Error())
+		return
+	}
 
-	log.Info("update script file, md5 ", updateConfig.MD5)
+	a.offerScript(updateConfig.MD5, buf)
 }
 
 func (a *Agent) currentScript() *Script {
 	return a.script
 }
 
+// renewScript replace the script, if the old script implement saveState
+// its state and processes are handed over to the new script
 func (a *Agent) renewScript() {
 	oldScript := a.script
-	if oldScript != nil {
+	state, handover := oldScript.saveState()
+	if oldScript == nil {
+		state = takeState(a.scriptStatePath())
+	} else if !handover {
 		oldScript.stop()
 	}
 
-	newScript := newScript(a, a.scriptFileMD5, a.scriptFileContent)
-	newScript.start()
+	newScript := newScript(a.host, a.config.Script, a.scriptFileMD5, a.scriptFileContent)
+	if handover {
+		oldScript.handover(newScript)
+	}
+	newScript.start(state)
 
 	a.script = newScript
 }
 
+// reload restart the script from disk, the processes it created keep running
+func (a *Agent) reload() {
+	log.Info("reload script from disk")
+	a.loadLocal()
+
+	oldScript := a.script
+	state, _ := oldScript.saveState()
+	newScript := newScript(a.host, a.config.Script, a.scriptFileMD5, a.scriptFileContent)
+	if oldScript != nil {
+		oldScript.handover(newScript)
+	} else {
+		state = takeState(a.scriptStatePath())
+	}
+	newScript.start(state)
+
+	a.script = newScript
+}
+
+func (a *Agent) heartbeatTimer() <-chan time.Time {
+	if a.config.HeartbeatInterval <= 0 {
+		return nil
+	}
+	return time.After(time.Second * time.Duration(a.config.HeartbeatInterval))
+}
+
+type Heartbeat struct {
+	Time      int64        `json:"time"`
+	Version   string       `json:"version"`
+	ScriptMD5 string       `json:"scriptMD5"`
+	Script    *ScriptStats `json:"script,omitempty"`
+
+	Plugins []*PluginStatus `json:"plugins,omitempty"`
+}
+
+func (a *Agent) heartbeat() {
+	hb := &Heartbeat{Time: time.Now().Unix(), Version: a.agentVersion, ScriptMD5: a.scriptFileMD5}
+	if script := a.currentScript(); script != nil && script.state != nil {
+		hb.Script = script.stats()
+	}
+	hb.Plugins = a.pluginStatuses()
+
+	err := a.report("heartbeat", hb)
+	if err != nil {
+		log.Errorf("heartbeat failed:%v", err)
+	}
+}
+
+func (a *Agent) setUpdateErr(err error) {
+	a.lastUpdateErr = err.Error()
+	a.lastUpdateErrTime = time.Now()
+}
+
+// reconcile start to install the packages of manifest, the result is
+// handled by finishReconcile when the downloads are done
+func (a *Agent) reconcile() {
+	if a.reconciler.manifest == nil || a.reconciler.running {
+		return
+	}
+
+	script := a.currentScript()
+	if script.hasLuaFunction("beforeReconcile") {
+		script.callModFunction1("beforeReconcile", lua.LString(a.reconciler.manifest.Version))
+	}
+
+	a.reconciler.start(a.config)
+}
+
+func (a *Agent) finishReconcile(job *reconcileJob) {
+	result := a.reconciler.finish(job)
+	if result == nil {
+		// manifest changed while installing, start with the new one
+		a.reconcile()
+		return
+	}
+
+	script := a.currentScript()
+	if len(result.Drift) > 0 || len(result.Errors) > 0 {
+		log.Infof("reconcile manifest %s, drift:%v, actions:%v, errors:%v", result.ManifestVersion, result.Drift, result.Actions, result.Errors)
+	}
+
+	if script.hasLuaFunction("afterReconcile") {
+		script.callModFunction1("afterReconcile", result.ToLuaTable(script.state))
+	}
+
+	if len(result.Drift) > 0 || len(result.Errors) > 0 || result.ManifestVersion != a.reportedManifestVersion {
+		err := a.report("reconcile", result)
+		if err != nil {
+			log.Errorf("report reconcile result failed:%v", err)
+			return
+		}
+		a.reportedManifestVersion = result.ManifestVersion
+	}
+}
+
 func (a *Agent) loadLocal() {
 	p := path.Join(a.args.WorkingDir, a.args.ScriptFileName)
 	b, err := os.ReadFile(p)
@@ -160,48 +486,161 @@ func (a *Agent) loadLocal() {
 	a.scriptFileMD5 = fmt.Sprintf("%x", md5.Sum(b))
 }
 
+// getUpdateConfigFromServer check in to the endpoints by priority,
+// it fail over to the next endpoint on network or server error
 func (a *Agent) getUpdateConfigFromServer() (*UpdateConfig, error) {
-	devInfoQuery := a.devInfo.ToURLQuery()
-	devInfoQuery.Add("version", a.agentVersion)
-	queryString := devInfoQuery.Encode()
+	var lastErr error
+	for _, e := range a.endpoints.candidates() {
+		updateConfig, reachable, err := a.checkin(e)
+		if err == nil {
+			a.endpoints.markSuccess(e)
+			a.publishInfo()
+			return updateConfig, nil
+		}
 
-	url := fmt.Sprintf("%s?%s", a.args.ServerURL, queryString)
+		if reachable {
+			// the server is up, other servers should give the same answer
+			return nil, err
+		}
+
+		log.Errorf("check in %s failed:%v", e.url, err)
+		a.endpoints.markFailure(e)
+		lastErr = err
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), httpTimeout)
+	a.refreshEndpoints()
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no server endpoint")
+	}
+	return nil, lastErr
+}
+
+// checkin return false if the endpoint is unreachable or has server error
+func (a *Agent) checkin(e *endpoint) (*UpdateConfig, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.httpClient.Timeout())
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req, err := a.newCheckinRequest(ctx, e)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
+	url := req.URL.String()
 
-	resp, err := http.DefaultClient.Do(req)
+	if len(a.updateConfigETag) > 0 {
+		req.Header.Set("If-None-Match", a.updateConfigETag)
+	}
+
+	resp, err := a.httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	var body []byte
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Read and handle the response
+		body, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, false, err
+		}
+	case http.StatusNotModified:
+		body = a.updateConfigBody
+	default:
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("getScriptInfoFromServer status code: %d, msg: %s, url: %s", resp.StatusCode, string(body), url)
+		if req.Method == http.MethodPost && isLegacyServer(resp.StatusCode, body) {
+			log.Warnf("server %s not support check in with POST, fallback to GET", e.url)
+			e.legacyCheckin = true
+		}
+		err = fmt.Errorf("getScriptInfoFromServer status code: %d, msg: %s, url: %s", resp.StatusCode, string(body), url)
+		return nil, resp.StatusCode < http.StatusInternalServerError, err
 	}
 
-	// Read and handle the response
-	body, err := io.ReadAll(resp.Body)
+	updateConfig := &UpdateConfig{}
+	err = json.Unmarshal(body, updateConfig)
+	if err != nil {
+		return nil, true, fmt.Errorf("getScriptInfoFromServer unmarshal update config: %s", err.Error())
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		a.updateConfigETag = resp.Header.Get("ETag")
+		a.updateConfigBody = body
+	}
+	return updateConfig, true, nil
+}
+
+// newCheckinRequest post the device info as gzip json, or put it in
+// the query string for legacy server
+func (a *Agent) newCheckinRequest(ctx context.Context, e *endpoint) (*http.Request, error) {
+	if e.legacyCheckin {
+		devInfoQuery := a.devInfo.ToURLQuery()
+		devInfoQuery.Add("version", a.agentVersion)
+		devInfoQuery.Add("goos", runtime.GOOS)
+		devInfoQuery.Add("goarch", runtime.GOARCH)
+		// the token also register the key of device enrolled before it had one
+		if len(a.config.EnrollToken) > 0 {
+			devInfoQuery.Add("enrollToken", a.config.EnrollToken)
+		}
+		devInfoQuery.Add("publicKey", a.publicKey())
+		queryString := devInfoQuery.Encode()
+
+		url := fmt.Sprintf("%s?%s", e.url, queryString)
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
+	}
+
+	checkin := &protocol.CheckinRequest{
+		SchemaVersion: protocol.CheckinSchemaVersion,
+		AgentVersion:  a.agentVersion,
+		GOOS:          runtime.GOOS,
+		GOARCH:        runtime.GOARCH,
+		Device:        a.devInfo.ToProtocol(),
+		// the token also register the key of device enrolled before it had one
+		EnrollToken: a.config.EnrollToken,
+		PublicKey:   a.publicKey(),
+	}
+
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	err := json.NewEncoder(zw).Encode(checkin)
 	if err != nil {
 		return nil, err
 	}
 
-	updateConfig := &UpdateConfig{}
-	err = json.Unmarshal(body, updateConfig)
+	err = zw.Close()
 	if err != nil {
-		return nil, nil
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.url, buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	return req, nil
+}
+
+// isLegacyServer check whether the error response come from a server
+// without POST check in, new server always return json error
+func isLegacyServer(statusCode int, body []byte) bool {
+	switch statusCode {
+	case http.StatusMethodNotAllowed, http.StatusUnsupportedMediaType:
+		return true
+	case http.StatusBadRequest:
+		errRsp := &protocol.ErrorResponse{}
+		if json.Unmarshal(body, errRsp) != nil || len(errRsp.Error) == 0 {
+			return true
+		}
+		// server rejecting the fields or schema of this agent still accept
+		// the query string check in
+		return strings.Contains(errRsp.Error, "unknown field") || strings.HasPrefix(errRsp.Error, "unsupported schema version")
 	}
-	return updateConfig, nil
+	return false
 }
 
 func (a *Agent) getScriptFromServer(url string) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), httpTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), a.httpClient.Timeout())
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
@@ -209,7 +648,7 @@ func (a *Agent) getScriptFromServer(url string) ([]byte, error) {
 		return nil, err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := a.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
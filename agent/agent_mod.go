@@ -3,6 +3,7 @@ package agent
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
@@ -23,11 +24,12 @@ import (
 const ExecTimeout = 10
 
 type AgentModule struct {
-	agent *Agent
+	host  *scriptHost
+	owner *Script
 }
 
-func newAgentModule(agent *Agent) *AgentModule {
-	am := &AgentModule{agent: agent}
+func newAgentModule(s *Script) *AgentModule {
+	am := &AgentModule{host: s.host, owner: s}
 
 	return am
 }
@@ -44,9 +46,18 @@ func (am *AgentModule) loader(L *lua.LState) int {
 		"execWithDetach": am.execWithDetach,
 		"chmod":          am.chmod,
 		"exec":           am.exec,
+		"resolve":        am.resolve,
+		"async":          am.async,
+		"pcall":          am.pcall,
+		"stats":          am.stats,
+		"readAsset":      am.readAsset,
+		"assetPath":      am.assetPath,
+		"readyForUpdate": am.readyForUpdate,
 	}
 
 	mod := L.SetFuncs(L.NewTable(), exports)
+	L.SetField(mod, "sleep", am.owner.awaitable(L, am.sleep))
+	L.SetField(mod, "execAsync", am.owner.awaitable(L, am.execAsync))
 
 	// returns the module
 	L.Push(mod)
@@ -60,6 +71,12 @@ func (ag *AgentModule) fileMD5(L *lua.LState) int {
 		L.Push(lua.LString("File path can not empty"))
 	}
 
+	if err := ag.owner.checkPaths(filePath); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
 	md5, err := fileMD5(filePath)
 	if err != nil {
 		L.Push(lua.LNil)
@@ -89,12 +106,47 @@ func fileMD5(filePath string) (string, error) {
 }
 
 func (am *AgentModule) info(L *lua.LState) int {
-	t := am.agent.devInfo.ToLuaTable(L)
-	t.RawSet(lua.LString("workingDir"), lua.LString(am.agent.args.WorkingDir))
-	t.RawSet(lua.LString("version"), lua.LString(am.agent.Version()))
-	t.RawSet(lua.LString("serverURL"), lua.LString(am.agent.args.ServerURL))
-	t.RawSet(lua.LString("scriptFileName"), lua.LString(am.agent.args.ScriptFileName))
-	t.RawSet(lua.LString("scriptInvterval"), lua.LNumber(am.agent.args.ScriptInvterval))
+	info := am.host.getInfo()
+	t := am.host.devInfo.ToLuaTable(L)
+	t.RawSet(lua.LString("workingDir"), lua.LString(am.host.workingDir))
+	t.RawSet(lua.LString("version"), lua.LString(am.host.version))
+	t.RawSet(lua.LString("serverURL"), lua.LString(info.serverURL))
+	t.RawSet(lua.LString("enrollStatus"), lua.LString(info.enrollStatus))
+	if len(am.owner.name) > 0 {
+		t.RawSet(lua.LString("scriptFileName"), lua.LString(pluginFileName(am.owner.name)))
+	} else {
+		t.RawSet(lua.LString("scriptFileName"), lua.LString(info.scriptFileName))
+	}
+	t.RawSet(lua.LString("scriptName"), lua.LString(am.owner.name))
+	t.RawSet(lua.LString("scriptInvterval"), lua.LNumber(info.scriptInterval))
+
+	L.Push(t)
+	return 1
+}
+
+// resolve return the ips of host with the agent resolver
+func (am *AgentModule) resolve(L *lua.LState) int {
+	host := L.CheckString(1)
+	if err := am.owner.sandbox.checkHost(host); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	ips, err := am.host.resolver.LookupHost(ctx, host)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	t := L.NewTable()
+	for _, ip := range ips {
+		t.Append(lua.LString(ip))
+	}
 
 	L.Push(t)
 	return 1
@@ -104,7 +156,10 @@ func (am *AgentModule) extract7z(L *lua.LState) int {
 	filePath := L.CheckString(1)
 	outputDir := L.OptString(2, filepath.Dir(filePath))
 
-	err := extract7z(filePath, outputDir)
+	err := am.owner.checkPaths(filePath, outputDir)
+	if err == nil {
+		err = extract7z(filePath, outputDir)
+	}
 	if err != nil {
 		L.Push(lua.LString(err.Error()))
 	} else {
@@ -162,7 +217,10 @@ func (am *AgentModule) extractZip(L *lua.LState) int {
 	filePath := L.CheckString(1)
 	outputDir := L.OptString(2, filepath.Dir(filePath))
 
-	err := extractZip(filePath, outputDir)
+	err := am.owner.checkPaths(filePath, outputDir)
+	if err == nil {
+		err = extractZip(filePath, outputDir)
+	}
 	if err != nil {
 		L.Push(lua.LString(err.Error()))
 	} else {
@@ -219,6 +277,11 @@ func (am *AgentModule) copyDir(L *lua.LState) int {
 	srcDir := L.ToString(1)
 	dstDir := L.ToString(2)
 
+	if err := am.owner.checkPaths(srcDir, dstDir); err != nil {
+		L.Push(lua.LString(err.Error()))
+		return 1
+	}
+
 	err := copyDir(srcDir, dstDir)
 	if err != nil {
 		L.Push(lua.LString(fmt.Sprintf("Error copying directory: %s", err.Error())))
@@ -270,7 +333,11 @@ func copyDir(srcDir, dstDir string) error {
 }
 
 func (am *AgentModule) removeAll(L *lua.LState) int {
-	err := os.RemoveAll(L.CheckString(1))
+	dir := L.CheckString(1)
+	err := am.owner.checkPaths(dir)
+	if err == nil {
+		err = os.RemoveAll(dir)
+	}
 	if err != nil {
 		L.Push(lua.LString(err.Error()))
 		return 1
@@ -284,6 +351,12 @@ func (am *AgentModule) execWithDetach(L *lua.LState) int {
 	command := L.CheckString(1)
 	envStr := L.CheckString(2)
 
+	command, err := am.owner.sandbox.checkExec(command)
+	if err != nil {
+		L.Push(lua.LString(err.Error()))
+		return 1
+	}
+
 	args := strings.Split(command, " ")
 	newArgs := make([]string, 0, len(args))
 	for _, arg := range args {
@@ -331,6 +404,11 @@ func (am *AgentModule) chmod(L *lua.LState) int {
 	filePath := L.CheckString(1)
 	modeStr := L.CheckString(2)
 
+	if err := am.owner.checkPaths(filePath); err != nil {
+		L.Push(lua.LString(err.Error()))
+		return 1
+	}
+
 	// conver to octor
 	mode, err := strconv.ParseInt(modeStr, 8, 64)
 	if err != nil {
@@ -352,6 +430,156 @@ func (am *AgentModule) exec(L *lua.LState) int {
 	command := L.CheckString(1)
 	timeout := time.Duration(L.OptInt64(2, ExecTimeout)) * time.Second
 
+	command, err := am.owner.sandbox.checkExec(command)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := execCommand(ctx, command)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	L.Push(result.ToLuaTable(L))
+	return 1
+}
+
+// execAsync is exec for agent.async function, it return the result
+// table and raise error instead of returning it
+func (am *AgentModule) execAsync(L *lua.LState) int {
+	command := L.CheckString(1)
+	timeout := time.Duration(L.OptInt64(2, ExecTimeout)) * time.Second
+
+	command, err := am.owner.sandbox.checkExec(command)
+	if err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	return am.owner.await(L, "execAsync", func(co *coroutine) {
+		am.owner.execAsync(co, command, timeout)
+	})
+}
+
+// sleep suspend the agent.async function for n seconds
+func (am *AgentModule) sleep(L *lua.LState) int {
+	d := time.Duration(float64(L.CheckNumber(1)) * float64(time.Second))
+
+	return am.owner.await(L, "sleep", func(co *coroutine) {
+		am.owner.sleep(co, d)
+	})
+}
+
+// async run function as coroutine, the rest arguments are passed to it
+func (am *AgentModule) async(L *lua.LState) int {
+	fn := L.CheckFunction(1)
+	args := make([]lua.LValue, 0, L.GetTop())
+	for i := 2; i <= L.GetTop(); i++ {
+		args = append(args, L.Get(i))
+	}
+
+	am.owner.spawn(L, fn, nil, args...)
+	return 0
+}
+
+// pcall is the pcall for agent.async function, awaitable functions can be
+// called in it. It run the function as a child coroutine and wait for it
+func (am *AgentModule) pcall(L *lua.LState) int {
+	fn := L.CheckFunction(1)
+	args := make([]lua.LValue, 0, L.GetTop())
+	for i := 2; i <= L.GetTop(); i++ {
+		args = append(args, L.Get(i))
+	}
+
+	parent := am.owner.coroutines[L]
+	if parent == nil {
+		// not in coroutine, same as pcall
+		L.Push(fn)
+		for _, arg := range args {
+			L.Push(arg)
+		}
+		err := L.PCall(len(args), lua.MultRet, nil)
+		am.owner.checkLimitError(err)
+		rets := make([]lua.LValue, 0, L.GetTop())
+		for i := len(args) + 2; i <= L.GetTop(); i++ {
+			rets = append(rets, L.Get(i))
+		}
+		return pushValues(L, protectedResults(rets, err))
+	}
+
+	child := am.owner.spawn(L, fn, parent, args...)
+	if child.done {
+		return pushValues(L, protectedResults(child.rets, child.err))
+	}
+
+	// resumed with the results when the child finish
+	return am.owner.await(L, "pcall", func(co *coroutine) {})
+}
+
+// stats return the resource usage and limits of the script
+func (am *AgentModule) stats(L *lua.LState) int {
+	L.Push(am.owner.stats().ToLuaTable(L))
+	return 1
+}
+
+// readAsset return the content of the file in script bundle
+func (am *AgentModule) readAsset(L *lua.LState) int {
+	filePath, err := am.owner.assetPath(L.CheckString(1))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	buf, err := os.ReadFile(filePath)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	L.Push(lua.LString(buf))
+	return 1
+}
+
+// assetPath return the path of the file in script bundle, the file should not
+// be modified, it is removed when no script use the bundle
+func (am *AgentModule) assetPath(L *lua.LState) int {
+	filePath, err := am.owner.assetPath(L.CheckString(1))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	L.Push(lua.LString(filePath))
+	return 1
+}
+
+type execResult struct {
+	status int
+	stdout string
+	stderr string
+}
+
+func (r *execResult) ToLuaTable(L *lua.LState) *lua.LTable {
+	t := L.NewTable()
+	L.SetField(t, "stdout", lua.LString(r.stdout))
+	L.SetField(t, "stderr", lua.LString(r.stderr))
+	L.SetField(t, "status", lua.LNumber(r.status))
+	return t
+}
+
+// execCommand run command until it exit, it is killed when ctx is done
+func execCommand(ctx context.Context, command string) (*execResult, error) {
 	args := strings.Split(command, " ")
 	newArgs := make([]string, 0, len(args))
 	for _, arg := range args {
@@ -362,26 +590,17 @@ func (am *AgentModule) exec(L *lua.LState) int {
 	}
 
 	if len(newArgs) == 0 {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("args can not emtpy"))
-		return 2
+		return nil, fmt.Errorf("args can not emtpy")
 	}
 
-	var cmd *exec.Cmd
-	if len(newArgs) > 1 {
-		cmd = exec.Command(newArgs[0], newArgs[1:]...)
-	} else {
-		cmd = exec.Command(newArgs[0])
-	}
+	cmd := exec.Command(newArgs[0], newArgs[1:]...)
 
 	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
 	cmd.Stderr = &stderr
 	cmd.Stdout = &stdout
 
 	if err := cmd.Start(); err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString(err.Error()))
-		return 2
+		return nil, err
 	}
 
 	done := make(chan error)
@@ -390,27 +609,30 @@ func (am *AgentModule) exec(L *lua.LState) int {
 	}()
 
 	select {
-	case <-time.After(timeout):
+	case <-ctx.Done():
 		go cmd.Process.Kill()
-		L.Push(lua.LNil)
-		L.Push(lua.LString(`execute timeout`))
-		return 2
+		return nil, fmt.Errorf("execute timeout")
 	case err := <-done:
-		result := L.NewTable()
-		L.SetField(result, "stdout", lua.LString(stdout.String()))
-		L.SetField(result, "stderr", lua.LString(stderr.String()))
-		L.SetField(result, "status", lua.LNumber(-1))
-
+		result := &execResult{stdout: stdout.String(), stderr: stderr.String(), status: -1}
 		if err != nil {
 			if exiterr, ok := err.(*exec.ExitError); ok {
 				if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-					L.SetField(result, "status", lua.LNumber(int64(status.ExitStatus())))
+					result.status = status.ExitStatus()
 				}
 			}
 		} else {
-			L.SetField(result, "status", lua.LNumber(0))
+			result.status = 0
 		}
-		L.Push(result)
-		return 1
+		return result, nil
 	}
 }
+
+// readyForUpdate install the update deferred by the script once the
+// current lua call return, or offer the rejected update again. It does
+// nothing if no update is waiting
+func (am *AgentModule) readyForUpdate(L *lua.LState) int {
+	if am.owner.updateWaiting {
+		am.owner.updateReady = true
+	}
+	return 0
+}
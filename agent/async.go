@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// awaitWrapper wrap a yielding go function, the function is resumed with
+// (true, result) or (false, err) and the error is raised in the caller
+const awaitWrapper = `
+local fn = ...
+return function(...)
+	local ok, result = fn(...)
+	if not ok then
+		error(result, 2)
+	end
+	return result
+end
+`
+
+// coroutine is a lua function started by agent.async, it yield when it call
+// an awaitable function and is resumed by the event of the call
+type coroutine struct {
+	thread *lua.LState
+	fn     *lua.LFunction
+	// set when it yield by await, other yields are not resumed
+	waiting bool
+	// parent wait for it to finish in agent.pcall
+	parent *coroutine
+
+	done bool
+	rets []lua.LValue
+	err  error
+}
+
+// ResumeEvent resume the coroutine with the result of the awaited call,
+// result is called in script goroutine to build the lua value
+type ResumeEvent struct {
+	co     *coroutine
+	result func(L *lua.LState) (lua.LValue, error)
+}
+
+func (re *ResumeEvent) evtType() string {
+	return "resume"
+}
+
+// spawn run fn as a coroutine until it yield or return, L is the caller
+// so a coroutine can spawn another one
+func (s *Script) spawn(L *lua.LState, fn *lua.LFunction, parent *coroutine, args ...lua.LValue) *coroutine {
+	thread, _ := s.state.NewThread()
+	co := &coroutine{thread: thread, fn: fn, parent: parent}
+	s.coroutines[thread] = co
+	s.runCoroutine(L, co, args...)
+	return co
+}
+
+func (s *Script) runCoroutine(L *lua.LState, co *coroutine, args ...lua.LValue) {
+	co.waiting = false
+	// the coroutine run with the execution budget of the caller
+	if ctx := L.Context(); ctx != nil {
+		co.thread.SetContext(ctx)
+	}
+	state, err, rets := L.Resume(co.thread, co.fn, args...)
+	co.thread.RemoveContext()
+	if state == lua.ResumeYield {
+		if co.waiting {
+			return
+		}
+		err = fmt.Errorf("yield without await, use agent.sleep or other awaitable function")
+	}
+
+	delete(s.coroutines, co.thread)
+	co.done = true
+	co.rets = rets
+	co.err = err
+	s.checkLimitError(err)
+
+	parent := co.parent
+	if parent == nil {
+		if err != nil {
+			log.Errorf("async function %s failed:%v", co.fn, err)
+		}
+		return
+	}
+
+	// the parent is waiting in agent.pcall unless the coroutine finish
+	// before yielding the first time
+	if parent.waiting && s.coroutines[parent.thread] == parent {
+		s.runCoroutine(s.state, parent, protectedResults(co.rets, co.err)...)
+	}
+}
+
+// protectedResults return the results as pcall
+func protectedResults(rets []lua.LValue, err error) []lua.LValue {
+	if err != nil {
+		if aerr, ok := err.(*lua.ApiError); ok {
+			return []lua.LValue{lua.LFalse, aerr.Object}
+		}
+		return []lua.LValue{lua.LFalse, lua.LString(err.Error())}
+	}
+
+	return append([]lua.LValue{lua.LTrue}, rets...)
+}
+
+func pushValues(L *lua.LState, values []lua.LValue) int {
+	for _, v := range values {
+		L.Push(v)
+	}
+	return len(values)
+}
+
+// resumeCoroutine is called by events, the coroutine is ignored if it is
+// dropped or belong to a closed script
+func (s *Script) resumeCoroutine(co *coroutine, result lua.LValue, err error) {
+	if s.coroutines[co.thread] != co {
+		return
+	}
+
+	s.withBudget(co.fn.String(), func() {
+		if err != nil {
+			s.runCoroutine(s.state, co, lua.LFalse, lua.LString(err.Error()))
+			return
+		}
+		s.runCoroutine(s.state, co, lua.LTrue, result)
+	})
+}
+
+// await yield the coroutine running L, start begin the async work which
+// must push an event to resume the coroutine
+func (s *Script) await(L *lua.LState, name string, start func(co *coroutine)) int {
+	co := s.coroutines[L]
+	if co == nil {
+		L.RaiseError("%s must be called in agent.async function", name)
+		return 0
+	}
+
+	// a go function in the call stack, e.g. pcall, can not be yielded across
+	for level := 1; ; level++ {
+		dbg, ok := L.GetStack(level)
+		if !ok {
+			break
+		}
+
+		fn, err := L.GetInfo("f", dbg, lua.LNil)
+		if err == nil {
+			if f, ok := fn.(*lua.LFunction); ok && f.IsG {
+				L.RaiseError("%s can not be called inside go function such as pcall, use agent.pcall instead", name)
+				return 0
+			}
+		}
+	}
+
+	co.waiting = true
+	start(co)
+	return L.Yield()
+}
+
+// awaitable return a lua function that call the yielding fn and raise its error
+func (s *Script) awaitable(L *lua.LState, fn lua.LGFunction) *lua.LFunction {
+	wrapper, err := L.LoadString(awaitWrapper)
+	if err != nil {
+		L.RaiseError("load await wrapper failed:%v", err)
+	}
+
+	L.Push(wrapper)
+	L.Push(L.NewFunction(fn))
+	L.Call(1, 1)
+
+	ret := L.Get(-1)
+	L.Pop(1)
+	return ret.(*lua.LFunction)
+}
+
+// sleep resume the coroutine after d, it is canceled with the script
+func (s *Script) sleep(co *coroutine, d time.Duration) {
+	ctx := s.asyncCtx
+	go func() {
+		select {
+		case <-time.After(d):
+			s.pushEvt(&ResumeEvent{co: co, result: func(L *lua.LState) (lua.LValue, error) {
+				return lua.LNil, nil
+			}})
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// execAsync run the command in goroutine and resume the coroutine with
+// the same result table as agent.exec
+func (s *Script) execAsync(co *coroutine, command string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(s.asyncCtx, timeout)
+	go func() {
+		defer cancel()
+		result, err := execCommand(ctx, command)
+		if s.asyncCtx.Err() != nil {
+			return
+		}
+
+		s.pushEvt(&ResumeEvent{co: co, result: func(L *lua.LState) (lua.LValue, error) {
+			if err != nil {
+				return lua.LNil, err
+			}
+			return result.ToLuaTable(L), nil
+		}})
+	}()
+}
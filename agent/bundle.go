@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	bundleDirName = "bundles"
+	// the module loaded as the script, it return the mod table
+	bundleEntry = "main.lua"
+	// max uncompressed size of a bundle
+	maxBundleSize = 64 << 20
+)
+
+// isBundle return true if the script is a zip bundle, the bundle is
+// verified by md5 and signature as a whole like a single file script
+func isBundle(content []byte) bool {
+	return bytes.HasPrefix(content, []byte("PK\x03\x04"))
+}
+
+func bundleDir(workingDir, md5 string) string {
+	return path.Join(workingDir, bundleDirName, md5)
+}
+
+// unpackBundle extract the bundle to bundles/<md5> if it is not there, the
+// dir is shared by the scripts with the same md5
+func unpackBundle(workingDir, md5 string, content []byte) (string, error) {
+	dir := bundleDir(workingDir, md5)
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", fmt.Errorf("open bundle failed:%v", err)
+	}
+
+	err = os.MkdirAll(path.Dir(dir), os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	tmpDir, err := os.MkdirTemp(path.Dir(dir), md5+".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var total int64
+	for _, f := range reader.File {
+		total += int64(f.UncompressedSize64)
+		if total > maxBundleSize {
+			return "", fmt.Errorf("bundle exceed %d bytes", maxBundleSize)
+		}
+
+		err = unpackBundleFile(f, tmpDir)
+		if err != nil {
+			return "", fmt.Errorf("unpack bundle file %s failed:%v", f.Name, err)
+		}
+	}
+
+	if _, err := os.Stat(path.Join(tmpDir, bundleEntry)); err != nil {
+		return "", fmt.Errorf("bundle has no %s", bundleEntry)
+	}
+
+	err = os.Rename(tmpDir, dir)
+	if err != nil {
+		// unpacked by another script at the same time
+		if _, statErr := os.Stat(dir); statErr == nil {
+			return dir, nil
+		}
+		return "", err
+	}
+
+	return dir, nil
+}
+
+func unpackBundleFile(f *zip.File, dir string) error {
+	target, err := bundlePath(dir, f.Name)
+	if err != nil {
+		return err
+	}
+
+	if f.FileInfo().IsDir() {
+		return os.MkdirAll(target, os.ModePerm)
+	}
+
+	if !f.Mode().IsRegular() {
+		return fmt.Errorf("unsupported file mode %s", f.Mode())
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, io.LimitReader(rc, int64(f.UncompressedSize64)))
+	return err
+}
+
+// bundlePath return the path of name in the bundle dir, names escaping
+// the dir are rejected
+func bundlePath(dir, name string) (string, error) {
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dir, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(name) {
+		return "", fmt.Errorf("invalid path %s", name)
+	}
+	return target, nil
+}
+
+// loadBundle unpack the bundle and load its entry, the modules of the
+// bundle are found by require
+func (s *Script) loadBundle(content []byte) (*lua.LFunction, error) {
+	dir, err := unpackBundle(s.host.workingDir, s.fileMD5, content)
+	if err != nil {
+		return nil, err
+	}
+	s.bundleDir = dir
+
+	ls := s.state
+	pkg := ls.GetGlobal("package")
+	searchPath := filepath.Join(dir, "?.lua") + ";" + filepath.Join(dir, "?", "init.lua")
+	if old := lua.LVAsString(ls.GetField(pkg, "path")); len(old) > 0 {
+		searchPath += ";" + old
+	}
+	ls.SetField(pkg, "path", lua.LString(searchPath))
+
+	return ls.LoadFile(path.Join(dir, bundleEntry))
+}
+
+// assetPath return the path of the file in the bundle of script
+func (s *Script) assetPath(name string) (string, error) {
+	if len(s.bundleDir) == 0 {
+		return "", fmt.Errorf("script is not a bundle")
+	}
+	return bundlePath(s.bundleDir, name)
+}
+
+// cleanBundles remove the unpacked bundles no script use, the last known
+// good script is kept for fallback
+func (a *Agent) cleanBundles() {
+	dirs, err := os.ReadDir(path.Join(a.args.WorkingDir, bundleDirName))
+	if err != nil {
+		return
+	}
+
+	inUse := map[string]bool{a.scriptFileMD5: true, a.goodScriptMD5: true}
+	if a.script != nil {
+		inUse[a.script.fileMD5] = true
+	}
+	for _, status := range a.pluginStatuses() {
+		inUse[status.MD5] = true
+	}
+
+	for _, d := range dirs {
+		if inUse[d.Name()] {
+			continue
+		}
+
+		// temp dirs of unpacking plugins are left to them
+		if strings.Contains(d.Name(), ".tmp") {
+			continue
+		}
+
+		log.Infof("remove unused bundle %s", d.Name())
+		os.RemoveAll(path.Join(a.args.WorkingDir, bundleDirName, d.Name()))
+	}
+}
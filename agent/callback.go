@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaCallback is a lua function passed to timer, downloader or process api,
+// or the name of a function in mod table for old scripts. It is only touched
+// by the script goroutine: events carry the owner of the callback and it is
+// looked up when the event is handled, so a deleted one is never called and
+// the function is released with its owner
+type luaCallback struct {
+	name string
+	fn   *lua.LFunction
+}
+
+func (cb *luaCallback) String() string {
+	if cb.fn != nil {
+		return cb.fn.String()
+	}
+	return cb.name
+}
+
+// checkCallback return the callback at stack index n, it accept a function
+// value or the name of a function in mod table
+func (s *Script) checkCallback(L *lua.LState, n int) (*luaCallback, error) {
+	switch v := L.Get(n).(type) {
+	case *lua.LFunction:
+		return &luaCallback{fn: v}, nil
+	case lua.LString:
+		if !s.hasLuaFunction(string(v)) {
+			return nil, fmt.Errorf("Func %s not exist", v)
+		}
+		return &luaCallback{name: string(v)}, nil
+	}
+
+	return nil, fmt.Errorf("callback must be function or function name, got %s", L.Get(n).Type())
+}
+
+// optCallback is checkCallback for optional argument
+func (s *Script) optCallback(L *lua.LState, n int) (*luaCallback, error) {
+	if L.Get(n) == lua.LNil {
+		return nil, nil
+	}
+	return s.checkCallback(L, n)
+}
+
+func (s *Script) callCallback(cb *luaCallback, args ...lua.LValue) {
+	if cb == nil {
+		return
+	}
+
+	if cb.fn != nil {
+		s.callFunction(cb.String(), cb.fn, args...)
+		return
+	}
+
+	if s.modTable != nil {
+		s.callFunction(cb.name, s.state.GetField(s.modTable, cb.name), args...)
+	}
+}
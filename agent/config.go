@@ -0,0 +1,429 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultConfigFileName = "agent.json"
+	// how often the config file is checked for change
+	configCheckInterval = 5 * time.Second
+)
+
+// AgentConfig is the content of the config file in working dir,
+// it can also be pushed by server in the update config
+type AgentConfig struct {
+	ServerURL string `json:"serverURL,omitempty"`
+	// fallback servers, tried in order when ServerURL is down
+	ServerURLs []string `json:"serverURLs,omitempty"`
+	// dns srv record name of the servers, e.g. _titan._tcp.example.com
+	ServerSRV      string `json:"serverSRV,omitempty"`
+	ScriptFileName string `json:"scriptFileName,omitempty"`
+	ScriptInterval int    `json:"scriptInterval,omitempty"`
+
+	// http, https or socks5 proxy url, default to the proxy environment variables
+	Proxy string      `json:"proxy,omitempty"`
+	TLS   *TLSConfig  `json:"tls,omitempty"`
+	HTTP  *HTTPConfig `json:"http,omitempty"`
+	DNS   *DNSConfig  `json:"dns,omitempty"`
+	Log   *LogConfig  `json:"log,omitempty"`
+
+	Script *ScriptConfig `json:"script,omitempty"`
+
+	// seconds between heartbeat, 0 disable heartbeat
+	HeartbeatInterval int `json:"heartbeatInterval,omitempty"`
+	// base64 ed25519 public keys, if set the script must be signed by one of them
+	TrustedKeys []string `json:"trustedKeys,omitempty"`
+	// token presented to server until the device is enrolled
+	EnrollToken string `json:"enrollToken,omitempty"`
+}
+
+type TLSConfig struct {
+	CAFile             string `json:"caFile,omitempty"`
+	CertFile           string `json:"certFile,omitempty"`
+	KeyFile            string `json:"keyFile,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+type HTTPConfig struct {
+	// seconds, timeout of the requests to server, downloads have their own timeout
+	Timeout        int               `json:"timeout,omitempty"`
+	ConnectTimeout int               `json:"connectTimeout,omitempty"`
+	UserAgent      string            `json:"userAgent,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	// max concurrent requests of httpc module in a script, default 4
+	MaxScriptRequests int `json:"maxScriptRequests,omitempty"`
+}
+
+type ScriptConfig struct {
+	// seconds, execution budget of a lua call such as a timer callback, default 30
+	CallTimeout int `json:"callTimeout,omitempty"`
+	// budget violations before the script is replaced by the last known
+	// good one, default 3
+	MaxViolations int `json:"maxViolations,omitempty"`
+	// max depth of lua call stack, default 256
+	CallStackSize int `json:"callStackSize,omitempty"`
+	// max slots of lua registry (the value stack), default 262144
+	RegistryMaxSize int `json:"registryMaxSize,omitempty"`
+	// MB, approximate heap used by the script, default 128
+	MaxMemory int `json:"maxMemory,omitempty"`
+	// seconds, how long the running script can defer an update, default 1800
+	MaxUpdateDefer int `json:"maxUpdateDefer,omitempty"`
+	// what the script is allowed to do, not restricted if it is not set
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+}
+
+type LogConfig struct {
+	Level string `json:"level,omitempty"`
+	File  string `json:"file,omitempty"`
+}
+
+// PushedConfig is the part of config the server is allowed to push, the
+// other settings decide where the agent connect, what file it write and what
+// the script can do, they can only be set locally. A field not pushed or null
+// keep the local value, zero clear it
+type PushedConfig struct {
+	ScriptInterval    *int             `json:"scriptInterval"`
+	HeartbeatInterval *int             `json:"heartbeatInterval"`
+	Log               *PushedLogConfig `json:"log"`
+}
+
+type PushedLogConfig struct {
+	Level *string `json:"level"`
+}
+
+// merge copy the non zero fields of o to c
+func (c *AgentConfig) merge(o *AgentConfig) {
+	if o == nil {
+		return
+	}
+
+	if len(o.ServerURL) > 0 {
+		c.ServerURL = o.ServerURL
+	}
+	if len(o.ServerURLs) > 0 {
+		c.ServerURLs = o.ServerURLs
+	}
+	if len(o.ServerSRV) > 0 {
+		c.ServerSRV = o.ServerSRV
+	}
+	if len(o.ScriptFileName) > 0 {
+		c.ScriptFileName = o.ScriptFileName
+	}
+	if o.ScriptInterval > 0 {
+		c.ScriptInterval = o.ScriptInterval
+	}
+	if len(o.Proxy) > 0 {
+		c.Proxy = o.Proxy
+	}
+	if o.TLS != nil {
+		c.TLS = o.TLS
+	}
+	if o.HTTP != nil {
+		c.HTTP = o.HTTP
+	}
+	if o.DNS != nil {
+		c.DNS = o.DNS
+	}
+	if o.Log != nil {
+		c.Log = o.Log
+	}
+	if o.Script != nil {
+		c.Script = o.Script
+	}
+	if o.HeartbeatInterval > 0 {
+		c.HeartbeatInterval = o.HeartbeatInterval
+	}
+	if len(o.TrustedKeys) > 0 {
+		c.TrustedKeys = o.TrustedKeys
+	}
+	if len(o.EnrollToken) > 0 {
+		c.EnrollToken = o.EnrollToken
+	}
+}
+
+func (c *AgentConfig) verifyScript(content []byte, signature string) error {
+	if len(c.TrustedKeys) == 0 {
+		return nil
+	}
+
+	return c.verifySignature(content, signature)
+}
+
+// verifySignature require the content is signed by one of the trusted keys
+func (c *AgentConfig) verifySignature(content []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("decode signature failed:%v", err)
+	}
+
+	for _, k := range c.TrustedKeys {
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			log.Errorf("invalid trusted key %s", k)
+			continue
+		}
+
+		if ed25519.Verify(ed25519.PublicKey(key), content, sig) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("not signed by trusted keys")
+}
+
+func (a *Agent) configFilePath() string {
+	name := a.baseArgs.ConfigFileName
+	if len(name) == 0 {
+		name = defaultConfigFileName
+	}
+
+	if path.IsAbs(name) {
+		return name
+	}
+	return path.Join(a.baseArgs.WorkingDir, name)
+}
+
+func (a *Agent) readConfigFile() (*AgentConfig, time.Time, error) {
+	filePath := a.configFilePath()
+	info, err := os.Stat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, time.Time{}, nil
+		}
+		return nil, time.Time{}, err
+	}
+
+	buf, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	config := &AgentConfig{}
+	err = json.Unmarshal(buf, config)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return config, info.ModTime(), nil
+}
+
+// loadConfig merge flag defaults, config file and flag overrides,
+// it return true if the script need to restart for the new config
+func (a *Agent) loadConfig() (bool, error) {
+	fileConfig, modTime, err := a.readConfigFile()
+	if err != nil {
+		return false, err
+	}
+	a.configModTime = modTime
+
+	config := &AgentConfig{
+		ServerURL:      a.baseArgs.ServerURL,
+		ScriptFileName: a.baseArgs.ScriptFileName,
+		ScriptInterval: a.baseArgs.ScriptInvterval,
+	}
+	config.merge(fileConfig)
+	config.merge(&a.baseArgs.Overrides)
+
+	if a.config != nil && reflect.DeepEqual(a.config, config) {
+		return false, nil
+	}
+
+	restartScript := a.config != nil && a.config.ScriptFileName != config.ScriptFileName
+	err = a.applyConfig(config)
+	if err != nil {
+		return false, err
+	}
+
+	// the srv record is looked up with the dns config just applied
+	urls := a.endpointURLs(config)
+	if len(urls) == 0 {
+		return false, fmt.Errorf("server url not set")
+	}
+	a.setEndpoints(urls)
+
+	return restartScript, nil
+}
+
+func (a *Agent) applyConfig(config *AgentConfig) error {
+	err := a.httpClient.update(config)
+	if err != nil {
+		return err
+	}
+
+	if config.Log != nil {
+		err := applyLogConfig(config.Log)
+		if err != nil {
+			return err
+		}
+	}
+
+	a.config = config
+	a.args = &AgentArguments{
+		WorkingDir:      a.baseArgs.WorkingDir,
+		ScriptFileName:  config.ScriptFileName,
+		ScriptInvterval: config.ScriptInterval,
+		ServerURL:       config.ServerURL,
+	}
+
+	log.Infof("apply agent config, server url %s, script %s, interval %d", config.ServerURL, config.ScriptFileName, config.ScriptInterval)
+	return nil
+}
+
+// checkConfigFile reload the config if the file changed since last load
+func (a *Agent) checkConfigFile() {
+	info, err := os.Stat(a.configFilePath())
+	var modTime time.Time
+	if err == nil {
+		modTime = info.ModTime()
+	}
+
+	if modTime.Equal(a.configModTime) {
+		return
+	}
+
+	log.Info("config file changed, reload")
+	a.reloadConfig()
+}
+
+func (a *Agent) reloadConfig() {
+	restartScript, err := a.loadConfig()
+	if err != nil {
+		log.Errorf("reload config failed:%v", err)
+		return
+	}
+
+	if restartScript {
+		a.reload()
+	}
+}
+
+// updateConfigFile write the fields of PushedConfig into config file and
+// apply it, the other fields pushed by server are ignored
+func (a *Agent) updateConfigFile(raw json.RawMessage) {
+	pushed := &PushedConfig{}
+	err := json.Unmarshal(raw, pushed)
+	if err != nil {
+		log.Errorf("updateConfigFile unmarshal failed:%v", err)
+		return
+	}
+	if !bytes.Equal(raw, a.pushedConfig) {
+		a.pushedConfig = raw
+		warnIgnoredConfig(raw)
+	}
+
+	fileConfig, _, err := a.readConfigFile()
+	if err != nil {
+		log.Errorf("updateConfigFile read config file failed:%v", err)
+		return
+	}
+
+	config := &AgentConfig{}
+	if fileConfig != nil {
+		*config = *fileConfig
+	}
+	if pushed.ScriptInterval != nil && *pushed.ScriptInterval >= 0 {
+		config.ScriptInterval = *pushed.ScriptInterval
+	}
+	if pushed.HeartbeatInterval != nil && *pushed.HeartbeatInterval >= 0 {
+		config.HeartbeatInterval = *pushed.HeartbeatInterval
+	}
+	if pushed.Log != nil && pushed.Log.Level != nil {
+		level := *pushed.Log.Level
+		if _, err := log.ParseLevel(level); len(level) > 0 && err != nil {
+			log.Errorf("updateConfigFile ignore log level:%v", err)
+		} else {
+			logConfig := &LogConfig{Level: level}
+			if config.Log != nil {
+				logConfig.File = config.Log.File
+			}
+			if *logConfig == (LogConfig{}) {
+				logConfig = nil
+			}
+			config.Log = logConfig
+		}
+	}
+
+	if fileConfig != nil && reflect.DeepEqual(fileConfig, config) {
+		return
+	}
+
+	buf, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		log.Errorf("updateConfigFile marshal failed:%v", err)
+		return
+	}
+
+	err = os.WriteFile(a.configFilePath(), buf, 0644)
+	if err != nil {
+		log.Errorf("updateConfigFile write failed:%v", err)
+		return
+	}
+
+	log.Info("server push new config")
+	a.reloadConfig()
+}
+
+// warnIgnoredConfig log the pushed fields not in PushedConfig
+func warnIgnoredConfig(raw json.RawMessage) {
+	ignored := AgentConfig{}
+	if json.Unmarshal(raw, &ignored) != nil {
+		return
+	}
+
+	ignored.ScriptInterval = 0
+	ignored.HeartbeatInterval = 0
+	if ignored.Log != nil && len(ignored.Log.File) == 0 {
+		ignored.Log = nil
+	}
+	if !reflect.DeepEqual(ignored, AgentConfig{}) {
+		log.Warn("ignore config pushed by server except scriptInterval, heartbeatInterval and log level")
+	}
+}
+
+var logFile *os.File
+
+func applyLogConfig(config *LogConfig) error {
+	if len(config.Level) > 0 {
+		level, err := log.ParseLevel(config.Level)
+		if err != nil {
+			return err
+		}
+		log.SetLevel(level)
+	}
+
+	if logFile != nil && logFile.Name() == config.File {
+		return nil
+	}
+
+	var output io.Writer = os.Stderr
+	var f *os.File
+	if len(config.File) > 0 {
+		var err error
+		f, err = os.OpenFile(config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		// keep stderr, supervisor collect crash log from it
+		output = io.MultiWriter(os.Stderr, f)
+	}
+
+	log.SetOutput(output)
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = f
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"agent/protocol"
 	"bytes"
 	"fmt"
 	"net/url"
@@ -216,6 +217,31 @@ func (devInfo *DevInfo) ToURLQuery() url.Values {
 	return query
 }
 
+func (devInfo *DevInfo) ToProtocol() *protocol.DeviceInfo {
+	return &protocol.DeviceInfo{
+		HostName:        devInfo.HostName,
+		OS:              devInfo.OS,
+		Platform:        devInfo.Platform,
+		PlatformVersion: devInfo.PlatformVersion,
+		BootTime:        devInfo.BootTime,
+		Arch:            devInfo.Arch,
+
+		Macs: devInfo.Macs,
+
+		CPUModuleName:   devInfo.CPUModuleName,
+		CPUCores:        devInfo.CPUCores,
+		CPUMhz:          devInfo.CPUMhz,
+		TotalMemory:     devInfo.TotalMemory,
+		UsedMemory:      devInfo.UsedMemory,
+		AvailableMemory: devInfo.AvailableMemory,
+		Baseboard:       devInfo.Baseboard,
+
+		UUID:                devInfo.UUID,
+		AndroidID:           devInfo.AndroidID,
+		AndroidSerialNumber: devInfo.AndroidSerialNumber,
+	}
+}
+
 func (devInfo *DevInfo) ToLuaTable(L *lua.LState) *lua.LTable {
 	t := L.NewTable()
 	t.RawSet(lua.LString("hostname"), lua.LString(devInfo.HostName))
@@ -17,11 +17,11 @@ import (
 const downloadTimeout = 30
 
 type DownloadEvent struct {
-	tag      string
-	callback string
-	filePath string
-	md5      string
-	err      string
+	tag        string
+	downloader *Downloader
+	filePath   string
+	md5        string
+	err        string
 }
 
 func (de *DownloadEvent) evtType() string {
@@ -32,6 +32,8 @@ type DownloadModule struct {
 	owner *Script
 
 	downloaderMap map[string]*Downloader
+	// tag of downloaders created by fetch
+	fetchSeq int
 }
 
 func newDownloaderModule(s *Script) *DownloadModule {
@@ -51,6 +53,7 @@ func (dm *DownloadModule) loader(L *lua.LState) int {
 	}
 
 	mod := L.SetFuncs(L.NewTable(), exports)
+	L.SetField(mod, "fetch", dm.owner.awaitable(L, dm.fetchStub))
 
 	// returns the module
 	L.Push(mod)
@@ -61,13 +64,19 @@ func (dm *DownloadModule) createDownloadStub(L *lua.LState) int {
 	tag := L.CheckString(1)
 	filePath := L.CheckString(2)
 	url := L.CheckString(3)
-	callback := L.CheckString(4)
-	timeout := L.CheckInt64(5)
-	// fmt.Println("tag ", tag, " filePath ", filePath, " url ", url, " timeout ", timeout, " callback ", callback)
-	if !dm.owner.hasLuaFunction(callback) {
-		L.Push(lua.LString(fmt.Sprintf("Func %s not exist", callback)))
+	callback, err := dm.owner.checkCallback(L, 4)
+	if err != nil {
+		L.Push(lua.LString(err.Error()))
 		return 1
 	}
+	timeout := L.CheckInt64(5)
+	// optional table of request headers
+	headers := make(map[string]string)
+	if t, ok := L.Get(6).(*lua.LTable); ok {
+		t.ForEach(func(k, v lua.LValue) {
+			headers[k.String()] = v.String()
+		})
+	}
 
 	if len(tag) < 1 {
 		L.Push(lua.LString("Must set tag"))
@@ -78,6 +87,11 @@ func (dm *DownloadModule) createDownloadStub(L *lua.LState) int {
 		timeout = downloadTimeout
 	}
 
+	if err := dm.owner.checkDownload(filePath, url); err != nil {
+		L.Push(lua.LString(err.Error()))
+		return 1
+	}
+
 	_, exist := dm.downloaderMap[tag]
 	if exist {
 		log.Infof("downloader %s already exit", tag)
@@ -85,22 +99,66 @@ func (dm *DownloadModule) createDownloadStub(L *lua.LState) int {
 		return 1
 	}
 
-	ctx, ctxCancelFn := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
-	downloader := &Downloader{
+	downloader := dm.newDownloader(tag, timeout, headers)
+	downloader.callback = callback
+	dm.start(downloader, filePath, url)
+
+	return 0
+}
+
+// fetch(filePath, url, timeout, headers) download the file in agent.async
+// function, it return {tag, filePath, md5} and raise error if download failed
+func (dm *DownloadModule) fetchStub(L *lua.LState) int {
+	filePath := L.CheckString(1)
+	url := L.CheckString(2)
+	timeout := L.OptInt64(3, downloadTimeout)
+	headers := make(map[string]string)
+	if t, ok := L.Get(4).(*lua.LTable); ok {
+		t.ForEach(func(k, v lua.LValue) {
+			headers[k.String()] = v.String()
+		})
+	}
+
+	if timeout <= 0 {
+		timeout = downloadTimeout
+	}
+
+	if err := dm.owner.checkDownload(filePath, url); err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	return dm.owner.await(L, "fetch", func(co *coroutine) {
+		dm.fetchSeq++
+		tag := fmt.Sprintf("fetch-%d", dm.fetchSeq)
+		downloader := dm.newDownloader(tag, timeout, headers)
+		downloader.co = co
+		dm.start(downloader, filePath, url)
+	})
+}
+
+func (dm *DownloadModule) newDownloader(tag string, timeout int64, headers map[string]string) *Downloader {
+	ctx, ctxCancelFn := context.WithTimeout(dm.owner.sandbox.withContext(context.Background()), time.Duration(timeout)*time.Second)
+	return &Downloader{
 		tag:         tag,
-		callback:    callback,
 		ctx:         ctx,
 		ctxCancelFn: ctxCancelFn,
+		client:      dm.owner.host.httpClient,
+		headers:     headers,
 	}
+}
 
-	dm.downloaderMap[tag] = downloader
+// start download in goroutine, the result is sent by DownloadEvent
+func (dm *DownloadModule) start(downloader *Downloader, filePath, url string) {
+	dm.downloaderMap[downloader.tag] = downloader
 
 	go func() {
 		err := downloader.donwloadFile(filePath, url)
 		dv := &DownloadEvent{
-			tag:      downloader.tag,
-			callback: downloader.callback,
-			filePath: filePath,
+			tag:        downloader.tag,
+			downloader: downloader,
+			filePath:   filePath,
 		}
 
 		if err != nil {
@@ -114,8 +172,6 @@ func (dm *DownloadModule) createDownloadStub(L *lua.LState) int {
 
 		dm.owner.pushEvt(dv)
 	}()
-
-	return 0
 }
 
 func (dm *DownloadModule) deleteDownloadStub(L *lua.LState) int {
@@ -141,15 +197,23 @@ func (dm *DownloadModule) clear() {
 	dm.downloaderMap = make(map[string]*Downloader)
 }
 
+func (dm *DownloadModule) getDownloader(tag string) *Downloader {
+	return dm.downloaderMap[tag]
+}
+
 func (dm *DownloadModule) delete(tag string) {
 	delete(dm.downloaderMap, tag)
 }
 
 type Downloader struct {
-	tag         string
-	callback    string
+	tag      string
+	callback *luaCallback
+	// set if it is created by fetch
+	co          *coroutine
 	ctx         context.Context
 	ctxCancelFn context.CancelFunc
+	client      *HTTPClient
+	headers     map[string]string
 }
 
 func (downloader *Downloader) donwloadFile(filePath, url string) error {
@@ -158,7 +222,11 @@ func (downloader *Downloader) donwloadFile(filePath, url string) error {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	for k, v := range downloader.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := downloader.client.Do(req)
 	if err != nil {
 		return err
 	}
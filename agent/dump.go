@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const stateDumpFileName = "state-dump.json"
+
+type TimerState struct {
+	Tag      string `json:"tag"`
+	Interval int    `json:"interval"`
+	Callback string `json:"callback"`
+}
+
+type ProcessState struct {
+	Name string `json:"name"`
+	Pid  int    `json:"pid"`
+}
+
+type EndpointState struct {
+	URL       string `json:"url"`
+	Failures  int    `json:"failures"`
+	RetryTime string `json:"retryTime,omitempty"`
+}
+
+type StateDump struct {
+	Time              string `json:"time"`
+	Version           string `json:"version"`
+	ScriptMD5         string `json:"scriptMD5"`
+	GoodScriptMD5     string `json:"goodScriptMD5"`
+	LastUpdateErr     string `json:"lastUpdateErr"`
+	LastUpdateErrTime string `json:"lastUpdateErrTime"`
+
+	EnrollStatus string `json:"enrollStatus"`
+
+	ServerURL string           `json:"serverURL"`
+	Endpoints []*EndpointState `json:"endpoints"`
+
+	ScriptStats *ScriptStats `json:"scriptStats,omitempty"`
+	ScriptFault *ScriptFault `json:"scriptFault,omitempty"`
+
+	Plugins []*PluginStatus `json:"plugins"`
+
+	Timers       []*TimerState   `json:"timers"`
+	Downloads    []string        `json:"downloads"`
+	Processes    []*ProcessState `json:"processes"`
+	QueuedEvents int             `json:"queuedEvents"`
+
+	ManifestVersion  string          `json:"manifestVersion"`
+	ManagedProcesses []*ProcessState `json:"managedProcesses"`
+}
+
+func (a *Agent) stateDump() *StateDump {
+	dump := &StateDump{
+		Time:          time.Now().Format(time.RFC3339),
+		Version:       a.agentVersion,
+		ScriptMD5:     a.scriptFileMD5,
+		GoodScriptMD5: a.goodScriptMD5,
+		ScriptFault:   a.scriptFault,
+		LastUpdateErr: a.lastUpdateErr,
+		EnrollStatus:  string(a.enrollment.Status),
+		ServerURL:     a.serverURL(),
+		Plugins:       a.pluginStatuses(),
+	}
+
+	for _, e := range a.endpoints.endpoints {
+		state := &EndpointState{URL: e.url, Failures: e.failures}
+		if !e.retryTime.IsZero() {
+			state.RetryTime = e.retryTime.Format(time.RFC3339)
+		}
+		dump.Endpoints = append(dump.Endpoints, state)
+	}
+
+	if !a.lastUpdateErrTime.IsZero() {
+		dump.LastUpdateErrTime = a.lastUpdateErrTime.Format(time.RFC3339)
+	}
+
+	script := a.currentScript()
+	if script != nil && script.state != nil {
+		for _, t := range script.timerModule.timerMap {
+			dump.Timers = append(dump.Timers, &TimerState{Tag: t.tag, Interval: t.interval, Callback: t.callback.String()})
+		}
+		sort.Slice(dump.Timers, func(i, j int) bool { return dump.Timers[i].Tag < dump.Timers[j].Tag })
+
+		for tag := range script.downloadModule.downloaderMap {
+			dump.Downloads = append(dump.Downloads, tag)
+		}
+		sort.Strings(dump.Downloads)
+
+		for _, p := range script.processModule.processMap {
+			dump.Processes = append(dump.Processes, &ProcessState{Name: p.name, Pid: p.cmd.Process.Pid})
+		}
+		sort.Slice(dump.Processes, func(i, j int) bool { return dump.Processes[i].Name < dump.Processes[j].Name })
+
+		dump.QueuedEvents = len(script.eventsChan)
+		dump.ScriptStats = script.stats()
+	}
+
+	if a.reconciler.manifest != nil {
+		dump.ManifestVersion = a.reconciler.manifest.Version
+	}
+
+	for _, p := range a.reconciler.processes {
+		if p.isRunning() {
+			dump.ManagedProcesses = append(dump.ManagedProcesses, &ProcessState{Name: p.name, Pid: p.cmd.Process.Pid})
+		}
+	}
+	sort.Slice(dump.ManagedProcesses, func(i, j int) bool { return dump.ManagedProcesses[i].Name < dump.ManagedProcesses[j].Name })
+
+	return dump
+}
+
+// dumpState write the state to log and working dir
+func (a *Agent) dumpState() {
+	buf, err := json.MarshalIndent(a.stateDump(), "", "  ")
+	if err != nil {
+		log.Errorf("dumpState marshal failed:%v", err)
+		return
+	}
+
+	log.Infof("agent state:\n%s", string(buf))
+
+	filePath := path.Join(a.args.WorkingDir, stateDumpFileName)
+	err = os.WriteFile(filePath, buf, 0644)
+	if err != nil {
+		log.Errorf("dumpState write file failed:%v", err)
+	}
+}
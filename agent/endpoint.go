@@ -0,0 +1,228 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// bootstrap file in working dir, a json array of server urls
+	serversFileName = "servers.json"
+
+	minEndpointRetry   = 30 * time.Second
+	maxEndpointRetry   = 10 * time.Minute
+	srvLookupTimeout   = 5 * time.Second
+	defaultCheckinPath = "/update/lua"
+)
+
+// endpoint is a check in url and its health
+type endpoint struct {
+	url       string
+	failures  int
+	retryTime time.Time
+	// legacyCheckin is set when the server only support check in with GET
+	legacyCheckin bool
+}
+
+// endpointList keep the server endpoints in priority order, the first
+// healthy one is used, failed ones are retried after a backoff so the
+// agent fail back to the primary when it recover
+type endpointList struct {
+	endpoints []*endpoint
+	active    *endpoint
+}
+
+// newEndpointList keep the health of the endpoints already in old
+func newEndpointList(urls []string, old *endpointList) *endpointList {
+	known := make(map[string]*endpoint)
+	if old != nil {
+		for _, e := range old.endpoints {
+			known[e.url] = e
+		}
+	}
+
+	l := &endpointList{}
+	for _, u := range urls {
+		e := known[u]
+		if e == nil {
+			e = &endpoint{url: u}
+		}
+		l.endpoints = append(l.endpoints, e)
+	}
+
+	if old != nil && old.active != nil {
+		l.active = known[old.active.url]
+	}
+	if l.active == nil && len(l.endpoints) > 0 {
+		l.active = l.endpoints[0]
+	}
+
+	return l
+}
+
+func (l *endpointList) activeURL() string {
+	if l.active == nil {
+		return ""
+	}
+	return l.active.url
+}
+
+// candidates return the endpoints to try in order, the healthy ones by
+// priority, then the ones in backoff by retry time
+func (l *endpointList) candidates() []*endpoint {
+	now := time.Now()
+	healthy := make([]*endpoint, 0, len(l.endpoints))
+	waiting := make([]*endpoint, 0, len(l.endpoints))
+	for _, e := range l.endpoints {
+		if e.retryTime.After(now) {
+			waiting = append(waiting, e)
+		} else {
+			healthy = append(healthy, e)
+		}
+	}
+
+	sort.SliceStable(waiting, func(i, j int) bool { return waiting[i].retryTime.Before(waiting[j].retryTime) })
+
+	return append(healthy, waiting...)
+}
+
+func (l *endpointList) markSuccess(e *endpoint) {
+	e.failures = 0
+	e.retryTime = time.Time{}
+
+	if l.active != e {
+		log.Warnf("switch server endpoint from %s to %s", l.activeURL(), e.url)
+		l.active = e
+	}
+}
+
+func (l *endpointList) markFailure(e *endpoint) {
+	e.failures++
+
+	retry := minEndpointRetry
+	for i := 1; i < e.failures && retry < maxEndpointRetry; i++ {
+		retry = retry * 2
+	}
+	if retry > maxEndpointRetry {
+		retry = maxEndpointRetry
+	}
+	e.retryTime = time.Now().Add(retry)
+}
+
+// endpointURLs collect the server urls by priority: server url, server
+// url list, dns srv record and the bootstrap file in working dir
+func (a *Agent) endpointURLs(config *AgentConfig) []string {
+	urls := make([]string, 0)
+	if len(config.ServerURL) > 0 {
+		urls = append(urls, config.ServerURL)
+	}
+	urls = append(urls, config.ServerURLs...)
+
+	if len(config.ServerSRV) > 0 {
+		srvURLs, err := lookupSRVURLs(a.resolver, config.ServerSRV, config.ServerURL)
+		if err != nil {
+			log.Errorf("lookup server srv %s failed:%v", config.ServerSRV, err)
+		}
+		urls = append(urls, srvURLs...)
+	}
+
+	bootstrapURLs, err := readServersFile(path.Join(a.baseArgs.WorkingDir, serversFileName))
+	if err != nil {
+		log.Errorf("read %s failed:%v", serversFileName, err)
+	}
+	urls = append(urls, bootstrapURLs...)
+
+	result := make([]string, 0, len(urls))
+	seen := make(map[string]bool)
+	for _, u := range urls {
+		u = strings.TrimSpace(u)
+		if len(u) == 0 || seen[u] {
+			continue
+		}
+		seen[u] = true
+		result = append(result, u)
+	}
+
+	return result
+}
+
+// lookupSRVURLs build urls from the srv targets, scheme and path are
+// taken from serverURL if set
+func lookupSRVURLs(resolver *Resolver, name string, serverURL string) ([]string, error) {
+	scheme, p := "https", defaultCheckinPath
+	if len(serverURL) > 0 {
+		u, err := url.Parse(serverURL)
+		if err != nil {
+			return nil, err
+		}
+		scheme, p = u.Scheme, u.Path
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), srvLookupTimeout)
+	defer cancel()
+
+	records, err := resolver.LookupSRV(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := make([]string, 0, len(records))
+	for _, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		u := url.URL{Scheme: scheme, Host: net.JoinHostPort(host, fmt.Sprintf("%d", r.Port)), Path: p}
+		urls = append(urls, u.String())
+	}
+
+	return urls, nil
+}
+
+func readServersFile(filePath string) ([]string, error) {
+	buf, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	urls := make([]string, 0)
+	err = json.Unmarshal(buf, &urls)
+	if err != nil {
+		return nil, err
+	}
+
+	return urls, nil
+}
+
+// refreshEndpoints re-resolve the srv record and bootstrap file,
+// it is called when all the endpoints failed
+func (a *Agent) refreshEndpoints() {
+	urls := a.endpointURLs(a.config)
+	if len(urls) == 0 {
+		return
+	}
+	a.setEndpoints(urls)
+}
+
+// setEndpoints replace the server endpoints, only the requests to them
+// are signed with device key
+func (a *Agent) setEndpoints(urls []string) {
+	a.endpoints = newEndpointList(urls, a.endpoints)
+	a.httpClient.setSignedHosts(urls)
+	a.publishInfo()
+}
+
+// serverURL return the active check in url
+func (a *Agent) serverURL() string {
+	return a.endpoints.activeURL()
+}
@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"agent/protocol"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const enrollmentFileName = "enrollment.json"
+
+// enrollmentState is saved in working dir, DeviceID keep the device
+// identity stable across restarts
+type enrollmentState struct {
+	DeviceID string                `json:"deviceID"`
+	Status   protocol.EnrollStatus `json:"status,omitempty"`
+	Reason   string                `json:"reason,omitempty"`
+	Time     int64                 `json:"time,omitempty"`
+}
+
+func loadEnrollmentState(workingDir string) (*enrollmentState, error) {
+	buf, err := os.ReadFile(path.Join(workingDir, enrollmentFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	state := &enrollmentState{}
+	err = json.Unmarshal(buf, state)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func saveEnrollmentState(workingDir string, state *enrollmentState) error {
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path.Join(workingDir, enrollmentFileName), buf, 0644)
+}
+
+// loadEnrollment restore the device id, the first id is taken from
+// device info or generated if device has no uuid
+func (a *Agent) loadEnrollment() error {
+	state, err := loadEnrollmentState(a.baseArgs.WorkingDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("load enrollment failed:%v", err)
+	}
+
+	if state == nil || len(state.DeviceID) == 0 {
+		state = &enrollmentState{DeviceID: a.devInfo.UUID}
+		if len(state.DeviceID) == 0 {
+			state.DeviceID, err = newDeviceID()
+			if err != nil {
+				return err
+			}
+		}
+
+		err = saveEnrollmentState(a.baseArgs.WorkingDir, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	a.enrollment = state
+	a.devInfo.UUID = state.DeviceID
+	return nil
+}
+
+func (a *Agent) isEnrolled() bool {
+	return a.enrollment.Status == protocol.EnrollApproved
+}
+
+// setEnrollment save the enrollment result returned by server
+func (a *Agent) setEnrollment(e *protocol.Enrollment) {
+	if e.Status == a.enrollment.Status && e.Reason == a.enrollment.Reason {
+		return
+	}
+
+	log.Infof("device %s enrollment %s, reason %s", a.enrollment.DeviceID, e.Status, e.Reason)
+	a.enrollment.Status = e.Status
+	a.enrollment.Reason = e.Reason
+	a.enrollment.Time = time.Now().Unix()
+	a.publishInfo()
+
+	err := saveEnrollmentState(a.baseArgs.WorkingDir, a.enrollment)
+	if err != nil {
+		log.Errorf("save enrollment failed:%v", err)
+	}
+}
+
+// newDeviceID return a random uuid v4
+func newDeviceID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"sync"
+)
+
+// scriptHost is the part of agent used by the scripts, plugins use it
+// from their own goroutines so it only hold the fields fixed at start
+// and the info published by agent
+type scriptHost struct {
+	workingDir string
+	version    string
+	devInfo    *DevInfo
+	httpClient *HTTPClient
+	resolver   *Resolver
+	// wake up agent to report the plugin statuses
+	notifyPlugins func()
+
+	lock sync.Mutex
+	info *hostInfo
+}
+
+// hostInfo is the snapshot of the agent state changed by Run
+type hostInfo struct {
+	serverURL      string
+	enrollStatus   string
+	scriptFileName string
+	scriptInterval int
+}
+
+func (h *scriptHost) getInfo() *hostInfo {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.info
+}
+
+// publishInfo refresh the snapshot read by scripts, it is called by agent
+// after the config, endpoints or enrollment change
+func (a *Agent) publishInfo() {
+	info := &hostInfo{
+		serverURL:      a.serverURL(),
+		enrollStatus:   string(a.enrollment.Status),
+		scriptFileName: a.args.ScriptFileName,
+		scriptInterval: a.args.ScriptInvterval,
+	}
+
+	a.host.lock.Lock()
+	a.host.info = info
+	a.host.lock.Unlock()
+}
@@ -0,0 +1,310 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	lj "github.com/vadv/gopher-lua-libs/json"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// 16MB, larger response should be downloaded by downloader
+const maxHTTPCResponseSize = 16 << 20
+
+type HTTPCEvent struct {
+	request *httpcRequest
+	resp    *httpcResponse
+	err     error
+}
+
+func (he *HTTPCEvent) evtType() string {
+	return "httpc"
+}
+
+type httpcRequest struct {
+	id       int
+	req      *http.Request
+	cancel   context.CancelFunc
+	callback *luaCallback
+	// set if it is sent by fetch
+	co *coroutine
+}
+
+type httpcResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// HTTPCModule send http requests in goroutines with the agent http client,
+// the responses are delivered by events so the script is never blocked
+type HTTPCModule struct {
+	owner *Script
+
+	seq int
+	// queued and running requests
+	requests map[int]*httpcRequest
+	queue    []*httpcRequest
+	running  int
+}
+
+func newHTTPCModule(s *Script) *HTTPCModule {
+	hm := &HTTPCModule{
+		owner:    s,
+		requests: make(map[int]*httpcRequest),
+	}
+
+	return hm
+}
+
+func (hm *HTTPCModule) loader(L *lua.LState) int {
+	// register functions to the table
+	var exports = map[string]lua.LGFunction{
+		"request": hm.requestStub,
+		"cancel":  hm.cancelStub,
+	}
+
+	mod := L.SetFuncs(L.NewTable(), exports)
+	L.SetField(mod, "fetch", hm.owner.awaitable(L, hm.fetchStub))
+
+	// returns the module
+	L.Push(mod)
+	return 1
+}
+
+// request(options, callback) return the request id, callback is called with
+// (response, err). options: method, url, headers, body, json, timeout
+func (hm *HTTPCModule) requestStub(L *lua.LState) int {
+	options := L.CheckTable(1)
+	callback, err := hm.owner.checkCallback(L, 2)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	r, err := hm.newRequest(options)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	r.callback = callback
+	hm.send(r)
+
+	L.Push(lua.LNumber(r.id))
+	return 1
+}
+
+// fetch(options) send the request in agent.async function, it return the
+// response and raise error if the request failed
+func (hm *HTTPCModule) fetchStub(L *lua.LState) int {
+	options := L.CheckTable(1)
+	r, err := hm.newRequest(options)
+	if err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	return hm.owner.await(L, "fetch", func(co *coroutine) {
+		r.co = co
+		hm.send(r)
+	})
+}
+
+// cancel(id) cancel the request, its callback is not called and fetch
+// raise error
+func (hm *HTTPCModule) cancelStub(L *lua.LState) int {
+	id := L.CheckInt(1)
+	r := hm.requests[id]
+	if r == nil {
+		return 0
+	}
+
+	r.cancel()
+	delete(hm.requests, id)
+	for i, queued := range hm.queue {
+		if queued == r {
+			hm.queue = append(hm.queue[:i], hm.queue[i+1:]...)
+			break
+		}
+	}
+
+	if r.co != nil {
+		go hm.owner.pushEvt(&ResumeEvent{co: r.co, result: func(L *lua.LState) (lua.LValue, error) {
+			return lua.LNil, errors.New("request canceled")
+		}})
+	}
+
+	return 0
+}
+
+func (hm *HTTPCModule) newRequest(options *lua.LTable) (*httpcRequest, error) {
+	method := strings.ToUpper(lua.LVAsString(options.RawGetString("method")))
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+
+	url := lua.LVAsString(options.RawGetString("url"))
+	if len(url) == 0 {
+		return nil, fmt.Errorf("Must set url")
+	}
+
+	if err := hm.owner.sandbox.checkURL(url); err != nil {
+		return nil, err
+	}
+
+	var body io.Reader
+	contentType := ""
+	if v := options.RawGetString("json"); v != lua.LNil {
+		buf, err := lj.ValueEncode(v)
+		if err != nil {
+			return nil, fmt.Errorf("encode json failed:%v", err)
+		}
+		body = bytes.NewReader(buf)
+		contentType = "application/json"
+	} else if v := options.RawGetString("body"); v != lua.LNil {
+		body = strings.NewReader(lua.LVAsString(v))
+	}
+
+	timeout := hm.owner.host.httpClient.Timeout()
+	if v, ok := options.RawGetString("timeout").(lua.LNumber); ok && v > 0 {
+		timeout = time.Duration(float64(v) * float64(time.Second))
+	}
+
+	// canceled with the script
+	ctx, cancel := context.WithTimeout(hm.owner.sandbox.withContext(hm.owner.asyncCtx), timeout)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if headers, ok := options.RawGetString("headers").(*lua.LTable); ok {
+		headers.ForEach(func(k, v lua.LValue) {
+			req.Header.Set(k.String(), v.String())
+		})
+	}
+
+	hm.seq++
+	return &httpcRequest{id: hm.seq, req: req, cancel: cancel}, nil
+}
+
+// send start the request or queue it if too many requests are running
+func (hm *HTTPCModule) send(r *httpcRequest) {
+	hm.requests[r.id] = r
+	if hm.running >= hm.owner.host.httpClient.MaxScriptRequests() {
+		hm.queue = append(hm.queue, r)
+		return
+	}
+
+	hm.start(r)
+}
+
+func (hm *HTTPCModule) start(r *httpcRequest) {
+	hm.running++
+	client := hm.owner.host.httpClient
+	go func() {
+		resp, err := doHTTPCRequest(client, r.req)
+		r.cancel()
+		hm.owner.pushEvt(&HTTPCEvent{request: r, resp: resp, err: err})
+	}()
+}
+
+func doHTTPCRequest(client *HTTPClient, req *http.Request) (*httpcResponse, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPCResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > maxHTTPCResponseSize {
+		return nil, fmt.Errorf("response body exceed %d bytes", maxHTTPCResponseSize)
+	}
+
+	return &httpcResponse{status: resp.StatusCode, header: resp.Header, body: body}, nil
+}
+
+// handleEvent start the queued request and deliver the response, the
+// response of canceled request is dropped
+func (hm *HTTPCModule) handleEvent(e *HTTPCEvent) {
+	hm.running--
+	for len(hm.queue) > 0 && hm.running < hm.owner.host.httpClient.MaxScriptRequests() {
+		next := hm.queue[0]
+		hm.queue = hm.queue[1:]
+		hm.start(next)
+	}
+
+	r := e.request
+	if hm.requests[r.id] != r {
+		return
+	}
+	delete(hm.requests, r.id)
+
+	s := hm.owner
+	if r.co != nil {
+		if e.err != nil {
+			s.resumeCoroutine(r.co, lua.LNil, e.err)
+		} else {
+			s.resumeCoroutine(r.co, e.resp.ToLuaTable(s.state), nil)
+		}
+		return
+	}
+
+	if e.err != nil {
+		s.callCallback(r.callback, lua.LNil, lua.LString(e.err.Error()))
+	} else {
+		s.callCallback(r.callback, e.resp.ToLuaTable(s.state))
+	}
+}
+
+// ToLuaTable return {status, headers, body, json}, json is set if the
+// response is a valid json
+func (resp *httpcResponse) ToLuaTable(L *lua.LState) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("status", lua.LNumber(resp.status))
+	t.RawSetString("body", lua.LString(resp.body))
+
+	headers := L.NewTable()
+	for k := range resp.header {
+		headers.RawSetString(k, lua.LString(resp.header.Get(k)))
+	}
+	t.RawSetString("headers", headers)
+
+	if strings.Contains(resp.header.Get("Content-Type"), "json") {
+		v, err := lj.ValueDecode(L, resp.body)
+		if err != nil {
+			log.Debugf("httpc decode json response failed:%v", err)
+		} else {
+			t.RawSetString("json", v)
+		}
+	}
+
+	return t
+}
+
+func (hm *HTTPCModule) clear() {
+	for _, r := range hm.requests {
+		r.cancel()
+	}
+
+	hm.requests = make(map[int]*httpcRequest)
+	hm.queue = nil
+}
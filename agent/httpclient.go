@@ -0,0 +1,257 @@
+package agent
+
+import (
+	"agent/protocol"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConnectTimeout    = 10 * time.Second
+	defaultMaxScriptRequests = 4
+)
+
+// HTTPClient is shared by all the agent network requests, the settings
+// are replaced when the config reload
+type HTTPClient struct {
+	resolver *Resolver
+	// signer sign the requests to server endpoints with device key
+	signer func(req *http.Request) error
+
+	lock sync.RWMutex
+	// scheme and host of the server endpoints, other hosts never get the
+	// device signature
+	signedHosts map[string]bool
+
+	client    *http.Client
+	timeout   time.Duration
+	userAgent string
+	headers   map[string]string
+	// limit the httpc requests of a script
+	maxScriptRequests int
+}
+
+func newHTTPClient(resolver *Resolver) *HTTPClient {
+	c := &HTTPClient{
+		resolver:  resolver,
+		timeout:   httpTimeout,
+		userAgent: defaultUserAgent(),
+
+		maxScriptRequests: defaultMaxScriptRequests,
+	}
+	c.client = &http.Client{Transport: http.DefaultTransport, CheckRedirect: c.checkRedirect}
+	return c
+}
+
+func defaultUserAgent() string {
+	return fmt.Sprintf("titan-agent/%s (%s/%s)", version, runtime.GOOS, runtime.GOARCH)
+}
+
+// update build a new transport from config, the old one is kept on error
+func (c *HTTPClient) update(config *AgentConfig) error {
+	httpConfig := config.HTTP
+	if httpConfig == nil {
+		httpConfig = &HTTPConfig{}
+	}
+
+	connectTimeout := defaultConnectTimeout
+	if httpConfig.ConnectTimeout > 0 {
+		connectTimeout = time.Duration(httpConfig.ConnectTimeout) * time.Second
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           c.resolver.dialContext(dialer, true),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   connectTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	if len(config.Proxy) > 0 {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy %s:%v", config.Proxy, err)
+		}
+
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("unsupported proxy scheme %s", proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if config.TLS != nil {
+		tlsConfig, err := newTLSConfig(config.TLS)
+		if err != nil {
+			return err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	err := c.resolver.update(config.DNS, transport, dialer)
+	if err != nil {
+		return err
+	}
+
+	timeout := httpTimeout
+	if httpConfig.Timeout > 0 {
+		timeout = time.Duration(httpConfig.Timeout) * time.Second
+	}
+
+	userAgent := defaultUserAgent()
+	if len(httpConfig.UserAgent) > 0 {
+		userAgent = httpConfig.UserAgent
+	}
+
+	maxScriptRequests := defaultMaxScriptRequests
+	if httpConfig.MaxScriptRequests > 0 {
+		maxScriptRequests = httpConfig.MaxScriptRequests
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if old, ok := c.client.Transport.(*http.Transport); ok && old != http.DefaultTransport {
+		old.CloseIdleConnections()
+	}
+
+	// no client timeout, downloads are limited by their own context
+	c.client = &http.Client{Transport: transport, CheckRedirect: c.checkRedirect}
+	c.timeout = timeout
+	c.userAgent = userAgent
+	c.headers = httpConfig.Headers
+	c.maxScriptRequests = maxScriptRequests
+
+	return nil
+}
+
+func newTLSConfig(config *TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+
+	if len(config.CAFile) > 0 {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(config.CertFile) > 0 || len(config.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Do send the request with the user agent and default headers,
+// headers already set in the request are kept
+func (c *HTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.lock.RLock()
+	client, userAgent, headers := c.client, c.userAgent, c.headers
+	c.lock.RUnlock()
+
+	if len(req.Header.Get("User-Agent")) == 0 {
+		req.Header.Set("User-Agent", userAgent)
+	}
+
+	for k, v := range headers {
+		if len(req.Header.Get(k)) == 0 {
+			req.Header.Set(k, v)
+		}
+	}
+
+	if c.signer != nil && c.isSignedHost(req.URL) {
+		err := c.signer(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return client.Do(req)
+}
+
+// setSignedHosts set the server endpoints whose requests are signed
+func (c *HTTPClient) setSignedHosts(urls []string) {
+	hosts := make(map[string]bool)
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			continue
+		}
+		hosts[hostKey(u)] = true
+	}
+
+	c.lock.Lock()
+	c.signedHosts = hosts
+	c.lock.Unlock()
+}
+
+func (c *HTTPClient) isSignedHost(u *url.URL) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.signedHosts[hostKey(u)]
+}
+
+func hostKey(u *url.URL) string {
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// checkRedirect drop the device signature when the request is redirected
+// to a host other than the server endpoints
+func (c *HTTPClient) checkRedirect(req *http.Request, via []*http.Request) error {
+	err := checkRedirect(req, via)
+	if err != nil {
+		return err
+	}
+
+	if !c.isSignedHost(req.URL) {
+		for _, h := range []string{protocol.HeaderDeviceID, protocol.HeaderTimestamp, protocol.HeaderNonce, protocol.HeaderSignature} {
+			req.Header.Del(h)
+		}
+	}
+	return nil
+}
+
+// Timeout is the timeout of the api requests to server
+func (c *HTTPClient) Timeout() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.timeout
+}
+
+// MaxScriptRequests is the max concurrent httpc requests of a script
+func (c *HTTPClient) MaxScriptRequests() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.maxScriptRequests
+}
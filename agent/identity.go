@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"agent/protocol"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const deviceKeyFileName = "device.key"
+
+// IsWorkingDir return true if dir hold the identity files created by the
+// agent, it is checked before the dir is removed
+func IsWorkingDir(dir string) bool {
+	for _, name := range []string{deviceKeyFileName, enrollmentFileName} {
+		if info, err := os.Stat(path.Join(dir, name)); err != nil || !info.Mode().IsRegular() {
+			return false
+		}
+	}
+	return true
+}
+
+// loadDeviceKey return the device key in working dir, it is generated on first run
+func loadDeviceKey(workingDir string) (ed25519.PrivateKey, error) {
+	filePath := path.Join(workingDir, deviceKeyFileName)
+	buf, err := os.ReadFile(filePath)
+	if err == nil {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+		if err != nil || len(key) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("invalid device key %s", filePath)
+		}
+		return ed25519.PrivateKey(key), nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(filePath, []byte(base64.StdEncoding.EncodeToString(key)), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("generate device key %s", filePath)
+	return key, nil
+}
+
+func (a *Agent) publicKey() string {
+	return base64.StdEncoding.EncodeToString(a.deviceKey.Public().(ed25519.PublicKey))
+}
+
+// signRequest sign the request with device key, the body is hashed so
+// server can check it is not modified
+func (a *Agent) signRequest(req *http.Request) error {
+	body, err := requestBody(req)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	deviceID := a.enrollment.DeviceID
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+
+	host := req.Host
+	if len(host) == 0 {
+		host = req.URL.Host
+	}
+
+	s := protocol.SigningString(req.Method, host, req.URL.RequestURI(), deviceID, timestamp, nonceHex, protocol.BodyHash(body))
+	signature := ed25519.Sign(a.deviceKey, []byte(s))
+
+	req.Header.Set(protocol.HeaderDeviceID, deviceID)
+	req.Header.Set(protocol.HeaderTimestamp, timestamp)
+	req.Header.Set(protocol.HeaderNonce, nonceHex)
+	req.Header.Set(protocol.HeaderSignature, base64.StdEncoding.EncodeToString(signature))
+
+	return nil
+}
+
+// requestBody return a copy of the body, the request body is kept readable
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	defaultMaxMemoryMB     = 128
+	defaultRegistryMaxSize = 256 * 1024
+	// the min interval to walk the lua state after the lua calls
+	memoryCheckInterval = time.Second
+)
+
+// errors raised by lua state when it cross its limits
+var luaLimitErrors = []string{"callstack overflow", "registry overflow", "stack overflow"}
+
+// ScriptStats is the resource usage of a script, HeapBytes is estimated
+// from the lua values reachable by the script
+type ScriptStats struct {
+	HeapBytes       int64 `json:"heapBytes"`
+	MaxHeapBytes    int64 `json:"maxHeapBytes"`
+	Tables          int   `json:"tables"`
+	Functions       int   `json:"functions"`
+	Strings         int   `json:"strings"`
+	CallStackSize   int   `json:"callStackSize"`
+	RegistryMaxSize int   `json:"registryMaxSize"`
+
+	Coroutines int `json:"coroutines"`
+	Timers     int `json:"timers"`
+	Downloads  int `json:"downloads"`
+	Processes  int `json:"processes"`
+	Requests   int `json:"requests"`
+
+	Violations int    `json:"violations"`
+	LimitErr   string `json:"limitErr,omitempty"`
+}
+
+// luaOptions return the lua state options and the heap limit
+func (c *ScriptConfig) luaOptions() (lua.Options, int64) {
+	config := c
+	if config == nil {
+		config = &ScriptConfig{}
+	}
+
+	options := lua.Options{
+		CallStackSize:       lua.CallStackSize,
+		RegistrySize:        lua.RegistrySize,
+		RegistryMaxSize:     defaultRegistryMaxSize,
+		MinimizeStackMemory: true,
+	}
+	if config.CallStackSize > 0 {
+		options.CallStackSize = config.CallStackSize
+	}
+	if config.RegistryMaxSize > 0 {
+		options.RegistryMaxSize = config.RegistryMaxSize
+	}
+
+	maxMemory := int64(defaultMaxMemoryMB)
+	if config.MaxMemory > 0 {
+		maxMemory = int64(config.MaxMemory)
+	}
+
+	return options, maxMemory << 20
+}
+
+// setLimitErr mark the script to be unloaded, only the first error is kept
+func (s *Script) setLimitErr(reason string) {
+	if len(s.limitErr) > 0 {
+		return
+	}
+
+	s.limitErr = reason
+	log.Errorf("script %s cross its limit: %s", s.fileMD5, reason)
+}
+
+// checkLimitError check the error of lua call for stack and registry overflow
+func (s *Script) checkLimitError(err error) {
+	if err == nil {
+		return
+	}
+
+	msg := err.Error()
+	for _, limit := range luaLimitErrors {
+		if strings.Contains(msg, limit) {
+			s.setLimitErr(limit)
+			return
+		}
+	}
+}
+
+// stats walk the lua values reachable by the script to estimate its heap
+func (s *Script) stats() *ScriptStats {
+	stats := &ScriptStats{
+		MaxHeapBytes:    s.maxHeap,
+		CallStackSize:   s.options.CallStackSize,
+		RegistryMaxSize: s.options.RegistryMaxSize,
+		Violations:      s.violations,
+		LimitErr:        s.limitErr,
+		Coroutines:      len(s.coroutines),
+	}
+
+	if s.state == nil {
+		return stats
+	}
+
+	w := &heapWalker{stats: stats, visited: make(map[interface{}]bool)}
+	w.walk(s.state.G.Registry)
+	w.walk(s.state.G.Global)
+	if s.modTable != nil {
+		w.walk(s.modTable)
+	}
+
+	for _, co := range s.coroutines {
+		w.walk(co.fn)
+	}
+
+	if s.timerModule != nil {
+		stats.Timers = len(s.timerModule.timerMap)
+		for _, t := range s.timerModule.timerMap {
+			w.walkCallback(t.callback)
+		}
+	}
+
+	if s.downloadModule != nil {
+		stats.Downloads = len(s.downloadModule.downloaderMap)
+		for _, d := range s.downloadModule.downloaderMap {
+			w.walkCallback(d.callback)
+		}
+	}
+
+	if s.processModule != nil {
+		stats.Processes = len(s.processModule.processMap)
+		for _, p := range s.processModule.processMap {
+			w.walkCallback(p.onExit)
+		}
+	}
+
+	if s.httpcModule != nil {
+		stats.Requests = len(s.httpcModule.requests)
+		for _, r := range s.httpcModule.requests {
+			w.walkCallback(r.callback)
+		}
+	}
+
+	return stats
+}
+
+// ToLuaTable return the stats with the same keys as json
+func (stats *ScriptStats) ToLuaTable(L *lua.LState) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("heapBytes", lua.LNumber(stats.HeapBytes))
+	t.RawSetString("maxHeapBytes", lua.LNumber(stats.MaxHeapBytes))
+	t.RawSetString("tables", lua.LNumber(stats.Tables))
+	t.RawSetString("functions", lua.LNumber(stats.Functions))
+	t.RawSetString("strings", lua.LNumber(stats.Strings))
+	t.RawSetString("callStackSize", lua.LNumber(stats.CallStackSize))
+	t.RawSetString("registryMaxSize", lua.LNumber(stats.RegistryMaxSize))
+	t.RawSetString("coroutines", lua.LNumber(stats.Coroutines))
+	t.RawSetString("timers", lua.LNumber(stats.Timers))
+	t.RawSetString("downloads", lua.LNumber(stats.Downloads))
+	t.RawSetString("processes", lua.LNumber(stats.Processes))
+	t.RawSetString("requests", lua.LNumber(stats.Requests))
+	t.RawSetString("violations", lua.LNumber(stats.Violations))
+	t.RawSetString("limitErr", lua.LString(stats.LimitErr))
+	return t
+}
+
+// heapWalker estimate the size of lua values, the sizes are rough numbers
+// of the go structs behind them
+type heapWalker struct {
+	stats   *ScriptStats
+	visited map[interface{}]bool
+}
+
+func (w *heapWalker) walkCallback(cb *luaCallback) {
+	if cb != nil && cb.fn != nil {
+		w.walk(cb.fn)
+	}
+}
+
+func (w *heapWalker) walk(v lua.LValue) {
+	switch v := v.(type) {
+	case lua.LString:
+		w.stats.Strings++
+		w.stats.HeapBytes += int64(16 + len(v))
+	case *lua.LTable:
+		if w.visited[v] {
+			return
+		}
+		w.visited[v] = true
+		w.stats.Tables++
+		w.stats.HeapBytes += 64
+		v.ForEach(func(key, value lua.LValue) {
+			// slot of key and value
+			w.stats.HeapBytes += 40
+			w.walk(key)
+			w.walk(value)
+		})
+		w.walk(v.Metatable)
+	case *lua.LFunction:
+		if w.visited[v] {
+			return
+		}
+		w.visited[v] = true
+		w.stats.Functions++
+		w.stats.HeapBytes += int64(64 + 16*len(v.Upvalues))
+		for _, uv := range v.Upvalues {
+			w.walk(uv.Value())
+		}
+		if v.Env != nil {
+			w.walk(v.Env)
+		}
+		w.walkProto(v.Proto)
+	case *lua.LUserData:
+		if w.visited[v] {
+			return
+		}
+		w.visited[v] = true
+		w.stats.HeapBytes += 64
+		w.walk(v.Metatable)
+		if v.Env != nil {
+			w.walk(v.Env)
+		}
+	case *lua.LState:
+		w.stats.HeapBytes += 1024
+	}
+}
+
+func (w *heapWalker) walkProto(proto *lua.FunctionProto) {
+	if proto == nil || w.visited[proto] {
+		return
+	}
+	w.visited[proto] = true
+
+	w.stats.HeapBytes += int64(128 + 4*len(proto.Code) + 4*len(proto.DbgSourcePositions))
+	for _, c := range proto.Constants {
+		w.walk(c)
+	}
+	for _, p := range proto.FunctionPrototypes {
+		w.walkProto(p)
+	}
+}
+
+// checkMemory mark the script to be unloaded if its estimated heap is over
+// the limit, only the values reachable by the lua state are counted
+func (s *Script) checkMemory() {
+	if s == nil || s.state == nil {
+		return
+	}
+	s.lastMemoryCheck = time.Now()
+
+	stats := s.stats()
+	if stats.HeapBytes > stats.MaxHeapBytes {
+		s.setLimitErr(fmt.Sprintf("heap %d bytes exceed limit %d", stats.HeapBytes, stats.MaxHeapBytes))
+	}
+}
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const manifestFileName = "manifest.json"
+
+// Manifest is the desired state of a device delivered by the server
+type Manifest struct {
+	Version   string             `json:"version"`
+	Packages  []*ManifestPackage `json:"packages"`
+	Processes []*ManifestProcess `json:"processes"`
+	Files     []*ManifestFile    `json:"files"`
+}
+
+type ManifestPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	MD5     string `json:"md5"`
+	// base64 ed25519 signature of the package file, required if the
+	// agent has trusted keys
+	Signature string `json:"signature,omitempty"`
+}
+
+type ManifestProcess struct {
+	Name string   `json:"name"`
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+	Env  []string `json:"env"`
+	Dir  string   `json:"dir"`
+}
+
+type ManifestFile struct {
+	// relative to working dir, it can not be outside of it
+	Path    string `json:"path"`
+	Content string `json:"content"`
+	Mode    string `json:"mode"`
+}
+
+// specHash changes whenever anything that requires a restart of the process changes
+func (p *ManifestProcess) specHash() string {
+	buf, _ := json.Marshal(p)
+	return fmt.Sprintf("%x", md5.Sum(buf))
+}
+
+// expand replaces ${pkg:name} with the install dir of the package and
+// ${workingDir} with the agent working dir, other variables are kept as is
+func (m *Manifest) expand(s string, workingDir string) string {
+	return os.Expand(s, func(key string) string {
+		if key == "workingDir" {
+			return workingDir
+		}
+
+		if strings.HasPrefix(key, "pkg:") {
+			pkg := m.getPackage(strings.TrimPrefix(key, "pkg:"))
+			if pkg != nil {
+				return packageDir(workingDir, pkg)
+			}
+		}
+
+		return "${" + key + "}"
+	})
+}
+
+// validate reject the manifest which would write outside of the working dir
+func (m *Manifest) validate() error {
+	for _, pkg := range m.Packages {
+		if !isSafeName(pkg.Name) || !isSafeName(pkg.Version) {
+			return fmt.Errorf("invalid package name %q or version %q", pkg.Name, pkg.Version)
+		}
+	}
+
+	for _, f := range m.Files {
+		if !filepath.IsLocal(f.Path) || strings.Contains(f.Path, `\`) {
+			return fmt.Errorf("invalid file path %q, it must be relative to working dir", f.Path)
+		}
+	}
+
+	return nil
+}
+
+// isUnderDir check the real path of p is in dir
+func isUnderDir(p string, dir string) bool {
+	real, root := realPath(p), realPath(dir)
+	return strings.HasPrefix(real, root+string(filepath.Separator))
+}
+
+// isSafeName check the name can be used as a single path element
+func isSafeName(name string) bool {
+	return len(name) > 0 && name != "." && !strings.Contains(name, "..") && !strings.ContainsAny(name, `/\`)
+}
+
+func (m *Manifest) getPackage(name string) *ManifestPackage {
+	for _, p := range m.Packages {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func packageDir(workingDir string, pkg *ManifestPackage) string {
+	return path.Join(workingDir, "packages", pkg.Name, pkg.Version)
+}
+
+func loadManifest(workingDir string) (*Manifest, error) {
+	buf, err := os.ReadFile(path.Join(workingDir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	err = json.Unmarshal(buf, m)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func saveManifest(workingDir string, m *Manifest) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path.Join(workingDir, manifestFileName), buf, 0644)
+}
@@ -0,0 +1,518 @@
+package agent
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pluginDirName     = "plugins"
+	pluginFaultSuffix = ".fault.json"
+	// how often a plugin check its memory and refresh its status
+	pluginCheckInterval = 10 * time.Second
+)
+
+var pluginNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// PluginFile is a named script from update config, it run beside the main
+// script with its own lua state and event loop
+type PluginFile struct {
+	Name string `json:"name"`
+	MD5  string `json:"md5"`
+	URL  string `json:"url"`
+
+	Signature string `json:"signature,omitempty"`
+}
+
+// PluginStatus is reported to server when it change, and with heartbeat
+type PluginStatus struct {
+	Name    string       `json:"name"`
+	MD5     string       `json:"md5"`
+	Running bool         `json:"running"`
+	Fault   *ScriptFault `json:"fault,omitempty"`
+	Stats   *ScriptStats `json:"stats,omitempty"`
+	// the update deferred or rejected by the running script
+	Update *UpdateDecision `json:"update,omitempty"`
+}
+
+// pluginUpdate is sent to the plugin goroutine to replace its script
+type pluginUpdate struct {
+	md5     string
+	content []byte
+	config  *ScriptConfig
+}
+
+// plugin run its script in its own goroutine, a fault or an update of
+// the plugin does not touch the main script and other plugins
+type plugin struct {
+	name string
+	// shared with the agent, the plugin never touch the agent itself
+	host *scriptHost
+
+	// owned by the plugin goroutine
+	script  *Script
+	pending *pluginUpdate
+	timer   *time.Timer
+	// the update rejected by the script, it is offered again after the
+	// max deferral or when the script call readyForUpdate
+	rejected     *pluginUpdate
+	rejectedTime time.Time
+
+	// md5 of the last update sent to the plugin, owned by agent
+	latestMD5 string
+
+	updateChan chan *pluginUpdate
+	stopChan   chan struct{}
+	done       chan struct{}
+	// save the state for the next agent run when it is stopped
+	persist bool
+
+	lock   sync.Mutex
+	status *PluginStatus
+}
+
+func pluginFileName(name string) string {
+	return path.Join(pluginDirName, name+".lua")
+}
+
+func pluginPath(workingDir, name string) string {
+	return path.Join(workingDir, pluginFileName(name))
+}
+
+func pluginFaultPath(workingDir, name string) string {
+	return path.Join(workingDir, pluginDirName, name+pluginFaultSuffix)
+}
+
+func newPlugin(a *Agent, name string) *plugin {
+	p := &plugin{
+		name:       name,
+		host:       a.host,
+		updateChan: make(chan *pluginUpdate, 1),
+		stopChan:   make(chan struct{}),
+		done:       make(chan struct{}),
+		status:     &PluginStatus{Name: name},
+	}
+
+	if buf, err := os.ReadFile(pluginFaultPath(a.args.WorkingDir, name)); err == nil {
+		fault := &ScriptFault{}
+		if err := json.Unmarshal(buf, fault); err == nil {
+			p.status.Fault = fault
+		}
+	}
+
+	go p.run()
+	return p
+}
+
+func (p *plugin) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(pluginCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		p.protect(p.checkWatchdog)
+		p.protect(func() { p.checkPendingUpdate(false) })
+
+		var events <-chan ScriptEvent
+		if p.script != nil {
+			events = p.script.events()
+		}
+
+		var deadline <-chan time.Time
+		if p.pending != nil {
+			deadline = p.timer.C
+		}
+
+		select {
+		case ev := <-events:
+			p.protect(func() { p.script.handleEvent(ev) })
+		case u := <-p.updateChan:
+			p.protect(func() { p.offer(u) })
+		case <-deadline:
+			p.protect(func() { p.checkPendingUpdate(true) })
+		case <-ticker.C:
+			p.protect(func() {
+				p.script.checkMemory()
+				p.setStatus(nil)
+			})
+		case <-p.stopChan:
+			p.protect(func() {
+				if p.persist {
+					if state, ok := p.script.saveState(); ok {
+						writeState(pluginStatePath(p.host.workingDir, p.name), p.script.fileMD5, state)
+					}
+				}
+				p.dropPendingUpdate()
+				p.stopScript()
+			})
+			return
+		}
+	}
+}
+
+// protect unload the script if fn panic, so the agent and other
+// plugins keep running
+func (p *plugin) protect(fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("plugin %s panic:%v", p.name, r)
+			p.fault(fmt.Sprintf("panic: %v", r))
+		}
+	}()
+
+	fn()
+}
+
+// offer the update to the running script as the main script, it is
+// installed unless the script defer or reject it
+func (p *plugin) offer(u *pluginUpdate) {
+	p.dropPendingUpdate()
+
+	maxDefer := u.config.maxUpdateDefer()
+	decision, reason := p.script.offerUpdate(u.md5, maxDefer)
+	switch decision {
+	case updateDefer:
+		log.Infof("plugin %s update %s is deferred:%s", p.name, u.md5, reason)
+		p.pending = u
+		p.timer = time.NewTimer(maxDefer)
+	case updateReject:
+		log.Infof("plugin %s update %s is rejected:%s", p.name, u.md5, reason)
+		p.rejected = u
+		p.rejectedTime = time.Now()
+	default:
+		p.install(u)
+		return
+	}
+
+	p.setStatus(func(status *PluginStatus) {
+		status.Update = newUpdateDecision(p.name, u.md5, decision, reason)
+	})
+}
+
+// checkPendingUpdate install the deferred update once the script is ready
+// or the max deferral pass
+func (p *plugin) checkPendingUpdate(expired bool) {
+	if u := p.rejected; u != nil {
+		if (p.script != nil && p.script.updateReady) || time.Since(p.rejectedTime) > u.config.maxUpdateDefer() {
+			p.offer(u)
+		}
+		return
+	}
+
+	u := p.pending
+	if u == nil {
+		return
+	}
+
+	if !expired && p.script != nil && !p.script.updateReady {
+		return
+	}
+
+	p.dropPendingUpdate()
+	if expired {
+		log.Infof("plugin %s update %s deferred too long, install it", p.name, u.md5)
+	}
+	p.install(u)
+}
+
+func (p *plugin) dropPendingUpdate() {
+	if p.pending != nil {
+		p.timer.Stop()
+		p.pending = nil
+	}
+	p.rejected = nil
+}
+
+// install write the script file and replace the running script
+func (p *plugin) install(u *pluginUpdate) {
+	err := os.WriteFile(pluginPath(p.host.workingDir, p.name), u.content, 0644)
+	if err != nil {
+		log.Errorf("write plugin %s failed:%v", p.name, err)
+	}
+
+	p.renew(u)
+}
+
+// renew replace the script, the state and processes are handed over as
+// the main script
+func (p *plugin) renew(u *pluginUpdate) {
+	oldScript := p.script
+	state, handover := oldScript.saveState()
+	if oldScript == nil {
+		state = takeState(pluginStatePath(p.host.workingDir, p.name))
+	} else if !handover {
+		p.stopScript()
+	}
+
+	log.Infof("start plugin %s, md5 %s", p.name, u.md5)
+	script := newScript(p.host, u.config, u.md5, u.content)
+	script.name = p.name
+	if handover {
+		p.script = nil
+		oldScript.handover(script)
+	}
+	p.script = script
+	script.start(state)
+
+	p.setStatus(func(status *PluginStatus) {
+		status.MD5 = u.md5
+		status.Fault = nil
+		status.Update = nil
+	})
+	os.Remove(pluginFaultPath(p.host.workingDir, p.name))
+}
+
+// stopScript stop the script, a script broken by panic is dropped
+func (p *plugin) stopScript() {
+	script := p.script
+	if script == nil {
+		return
+	}
+	p.script = nil
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("plugin %s stop panic:%v", p.name, r)
+		}
+	}()
+	script.stop()
+}
+
+func (p *plugin) checkWatchdog() {
+	if p.script == nil {
+		return
+	}
+
+	if reason := p.script.faultReason(); len(reason) > 0 {
+		p.fault(reason)
+	}
+}
+
+// fault unload the script, it is not started again until the server
+// change the md5 of the plugin
+func (p *plugin) fault(reason string) {
+	fault := &ScriptFault{Time: time.Now().Unix(), Reason: reason}
+	if p.script != nil {
+		fault.MD5 = p.script.fileMD5
+		fault.Violations = p.script.violations
+	}
+
+	log.Errorf("plugin %s script %s %s, unload it", p.name, fault.MD5, reason)
+	p.stopScript()
+
+	buf, _ := json.Marshal(fault)
+	err := os.WriteFile(pluginFaultPath(p.host.workingDir, p.name), buf, 0644)
+	if err != nil {
+		log.Errorf("save plugin %s fault failed:%v", p.name, err)
+	}
+
+	p.setStatus(func(status *PluginStatus) {
+		status.Fault = fault
+	})
+}
+
+// setStatus refresh the status in plugin goroutine and notify agent
+func (p *plugin) setStatus(change func(status *PluginStatus)) {
+	p.lock.Lock()
+	status := *p.status
+	if change != nil {
+		change(&status)
+	}
+
+	status.Running = p.script != nil
+	status.Stats = nil
+	if p.script != nil {
+		status.Stats = p.script.stats()
+	}
+	p.status = &status
+	p.lock.Unlock()
+
+	p.host.notifyPlugins()
+}
+
+func (p *plugin) getStatus() *PluginStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.status
+}
+
+// isFaulted return true if the md5 is unloaded by the plugin watchdog
+func (p *plugin) isFaulted(md5 string) bool {
+	status := p.getStatus()
+	return status.Fault != nil && status.Fault.MD5 == md5
+}
+
+func (p *plugin) update(md5 string, content []byte, config *ScriptConfig) {
+	p.latestMD5 = md5
+
+	// drop the pending update, the latest one win
+	select {
+	case <-p.updateChan:
+	default:
+	}
+	p.updateChan <- &pluginUpdate{md5: md5, content: content, config: config}
+}
+
+// stop the plugin, persist keep its state for the next agent run
+func (p *plugin) stop(persist bool) {
+	p.persist = persist
+	close(p.stopChan)
+	<-p.done
+}
+
+// loadPlugins start the plugins installed in working dir
+func (a *Agent) loadPlugins() {
+	files, err := filepath.Glob(path.Join(a.args.WorkingDir, pluginDirName, "*.lua"))
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".lua")
+		if !pluginNameRegexp.MatchString(name) || a.plugins[name] != nil {
+			continue
+		}
+
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			log.Errorf("load plugin %s failed:%v", name, err)
+			continue
+		}
+
+		p := newPlugin(a, name)
+		fileMD5 := fmt.Sprintf("%x", md5.Sum(buf))
+		if !p.isFaulted(fileMD5) {
+			p.update(fileMD5, buf, a.config.Script)
+		}
+		a.plugins[name] = p
+	}
+}
+
+// updatePlugins install the plugins of update config, plugins not in the
+// list are stopped and removed
+func (a *Agent) updatePlugins(files []*PluginFile) {
+	names := make(map[string]bool)
+	for _, f := range files {
+		if !pluginNameRegexp.MatchString(f.Name) {
+			log.Errorf("invalid plugin name %s", f.Name)
+			continue
+		}
+		names[f.Name] = true
+
+		err := a.updatePlugin(f)
+		if err != nil {
+			a.setUpdateErr(fmt.Errorf("plugin %s:%v", f.Name, err))
+			log.Errorf("update plugin %s failed:%v", f.Name, err)
+		}
+	}
+
+	for name, p := range a.plugins {
+		if names[name] {
+			continue
+		}
+
+		log.Infof("remove plugin %s", name)
+		p.stop(false)
+		delete(a.plugins, name)
+		os.Remove(pluginPath(a.args.WorkingDir, name))
+		os.Remove(pluginFaultPath(a.args.WorkingDir, name))
+		os.Remove(pluginStatePath(a.args.WorkingDir, name))
+		a.notifyPlugins()
+	}
+}
+
+func (a *Agent) updatePlugin(f *PluginFile) error {
+	p := a.plugins[f.Name]
+	if p != nil && (p.latestMD5 == f.MD5 || p.isFaulted(f.MD5)) {
+		return nil
+	}
+
+	buf, err := a.getScriptFromServer(f.URL)
+	if err != nil {
+		return err
+	}
+
+	if fmt.Sprintf("%x", md5.Sum(buf)) != f.MD5 {
+		return fmt.Errorf("server script file md5 not match")
+	}
+
+	err = a.config.verifyScript(buf, f.Signature)
+	if err != nil {
+		return err
+	}
+
+	// the file is written by the plugin when the update is installed
+	err = os.MkdirAll(path.Join(a.args.WorkingDir, pluginDirName), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	if p == nil {
+		p = newPlugin(a, f.Name)
+		a.plugins[f.Name] = p
+	}
+	p.update(f.MD5, buf, a.config.Script)
+
+	log.Infof("update plugin %s, md5 %s", f.Name, f.MD5)
+	return nil
+}
+
+func (a *Agent) stopPlugins(persist bool) {
+	for _, p := range a.plugins {
+		p.stop(persist)
+	}
+}
+
+// pluginStatuses return the status of plugins sorted by name
+func (a *Agent) pluginStatuses() []*PluginStatus {
+	statuses := make([]*PluginStatus, 0, len(a.plugins))
+	for _, p := range a.plugins {
+		statuses = append(statuses, p.getStatus())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// notifyPlugins ask Run to report the plugin statuses
+func (a *Agent) notifyPlugins() {
+	select {
+	case a.pluginChan <- struct{}{}:
+	default:
+	}
+}
+
+// reportPlugins report the plugin statuses if they change, the stats are
+// only sent with heartbeat
+func (a *Agent) reportPlugins() {
+	statuses := a.pluginStatuses()
+	report := make([]*PluginStatus, 0, len(statuses))
+	for _, status := range statuses {
+		s := *status
+		s.Stats = nil
+		report = append(report, &s)
+	}
+
+	buf, err := json.Marshal(report)
+	if err != nil || string(buf) == a.reportedPlugins {
+		return
+	}
+
+	err = a.report("plugins", report)
+	if err != nil {
+		log.Errorf("report plugins failed:%v", err)
+		return
+	}
+	a.reportedPlugins = string(buf)
+}
@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// poll interval is randomized in [1-pollJitter, 1+pollJitter] so agents do not poll in lockstep
+	pollJitter = 0.2
+	// max poll interval after continuous errors
+	maxPollBackoff = 30 * time.Minute
+)
+
+// nextPollInterval return the delay before next check in, it prefer the
+// interval hint from server and backoff exponentially on errors
+func (a *Agent) nextPollInterval() time.Duration {
+	interval := time.Second * time.Duration(a.args.ScriptInvterval)
+	if a.serverPollInterval > 0 {
+		interval = a.serverPollInterval
+	}
+
+	for i := 0; i < a.pollFailures && interval < maxPollBackoff; i++ {
+		interval = interval * 2
+	}
+
+	if interval > maxPollBackoff {
+		interval = maxPollBackoff
+	}
+
+	return jitter(interval)
+}
+
+func jitter(d time.Duration) time.Duration {
+	factor := 1 - pollJitter + 2*pollJitter*rand.Float64()
+	return time.Duration(float64(d) * factor)
+}
@@ -5,13 +5,18 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
 	lua "github.com/yuin/gopher-lua"
 )
 
 type ProcessEvent struct {
-	name string
+	name     string
+	process  *Process
+	exitCode int
+	err      string
 }
 
 func (pe *ProcessEvent) evtType() string {
@@ -21,9 +26,17 @@ func (pe *ProcessEvent) evtType() string {
 type Process struct {
 	name string
 	cmd  *exec.Cmd
+	// optional, called with exit result when the process exit by itself
+	onExit *luaCallback
+	// coroutines waiting for the process exit
+	waiters []*coroutine
+	// set before the exit event is pushed to the owner
+	exited atomic.Bool
 }
 
 type ProcessModule struct {
+	// owner change when processes are handed over to a new script
+	ownerLock  sync.Mutex
 	owner      *Script
 	processMap map[string]*Process
 }
@@ -47,6 +60,7 @@ func (pm *ProcessModule) loader(L *lua.LState) int {
 	}
 
 	mod := L.SetFuncs(L.NewTable(), exports)
+	L.SetField(mod, "waitExit", pm.getOwner().awaitable(L, pm.waitExitStub))
 
 	// returns the module
 	L.Push(mod)
@@ -57,6 +71,11 @@ func (pm *ProcessModule) createProcessStub(L *lua.LState) int {
 	name := L.ToString(1)
 	command := L.ToString(2)
 	envStr := L.ToString(3)
+	onExit, err := pm.getOwner().optCallback(L, 4)
+	if err != nil {
+		L.Push(lua.LString(err.Error()))
+		return 1
+	}
 
 	log.Infof("createProcessStub name:%s", name)
 
@@ -70,6 +89,12 @@ func (pm *ProcessModule) createProcessStub(L *lua.LState) int {
 		return 0
 	}
 
+	command, err = pm.getOwner().sandbox.checkExec(command)
+	if err != nil {
+		L.Push(lua.LString(err.Error()))
+		return 1
+	}
+
 	env := pm.parseEnv(envStr)
 	cmd, err := pm.createProcess(command, env)
 	if err != nil {
@@ -84,8 +109,9 @@ func (pm *ProcessModule) createProcessStub(L *lua.LState) int {
 	}
 
 	process := &Process{
-		name: name,
-		cmd:  cmd,
+		name:   name,
+		cmd:    cmd,
+		onExit: onExit,
 	}
 
 	go pm.waitProcess(process)
@@ -151,13 +177,75 @@ func (pm *ProcessModule) getProcessStub(L *lua.LState) int {
 	return 0
 }
 
+// waitExit(name) wait the process exit in agent.async function, it
+// return {name, exitCode, err}
+func (pm *ProcessModule) waitExitStub(L *lua.LState) int {
+	name := L.CheckString(1)
+	process := pm.processMap[name]
+	if process == nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(fmt.Sprintf("Process %s not exist", name)))
+		return 2
+	}
+
+	return pm.getOwner().await(L, "waitExit", func(co *coroutine) {
+		process.waiters = append(process.waiters, co)
+	})
+}
+
 func (pm *ProcessModule) waitProcess(process *Process) {
 	err := process.cmd.Wait()
 	if err != nil {
 		log.Errorf("wait process %s, err:%v", process.name, err)
 	}
 
-	pm.owner.pushEvt(&ProcessEvent{name: process.name})
+	process.exited.Store(true)
+	ev := &ProcessEvent{
+		name:     process.name,
+		process:  process,
+		exitCode: process.cmd.ProcessState.ExitCode(),
+	}
+	if err != nil {
+		ev.err = err.Error()
+	}
+
+	pm.getOwner().pushEvt(ev)
+}
+
+func (pm *ProcessModule) getOwner() *Script {
+	pm.ownerLock.Lock()
+	defer pm.ownerLock.Unlock()
+	return pm.owner
+}
+
+func (pm *ProcessModule) setOwner(s *Script) {
+	pm.ownerLock.Lock()
+	defer pm.ownerLock.Unlock()
+	pm.owner = s
+}
+
+func (pm *ProcessModule) getProcess(name string) *Process {
+	return pm.processMap[name]
+}
+
+// dropCallbacks release the exit callbacks and waiters when the processes
+// are handed over
+func (pm *ProcessModule) dropCallbacks() {
+	for _, v := range pm.processMap {
+		v.onExit = nil
+		v.waiters = nil
+	}
+}
+
+// dropExited forget the processes exited before the owner change, their
+// exit events are queued in the old script and lost with it
+func (pm *ProcessModule) dropExited() {
+	for name, v := range pm.processMap {
+		if v.exited.Load() {
+			log.Infof("process %s exited during handover", name)
+			delete(pm.processMap, name)
+		}
+	}
 }
 
 func (pm *ProcessModule) delete(name string) {
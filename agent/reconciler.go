@@ -0,0 +1,435 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const packageDownloadTimeout = 10 * time.Minute
+
+type ReconcileResult struct {
+	ManifestVersion string   `json:"manifestVersion"`
+	Time            int64    `json:"time"`
+	Drift           []string `json:"drift"`
+	Actions         []string `json:"actions"`
+	Errors          []string `json:"errors"`
+}
+
+func (r *ReconcileResult) drift(format string, args ...interface{}) {
+	r.Drift = append(r.Drift, fmt.Sprintf(format, args...))
+}
+
+func (r *ReconcileResult) action(format string, args ...interface{}) {
+	r.Actions = append(r.Actions, fmt.Sprintf(format, args...))
+}
+
+func (r *ReconcileResult) error(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func (r *ReconcileResult) ToLuaTable(L *lua.LState) *lua.LTable {
+	toTable := func(list []string) *lua.LTable {
+		t := L.NewTable()
+		for _, v := range list {
+			t.Append(lua.LString(v))
+		}
+		return t
+	}
+
+	t := L.NewTable()
+	t.RawSet(lua.LString("manifestVersion"), lua.LString(r.ManifestVersion))
+	t.RawSet(lua.LString("time"), lua.LNumber(r.Time))
+	t.RawSet(lua.LString("drift"), toTable(r.Drift))
+	t.RawSet(lua.LString("actions"), toTable(r.Actions))
+	t.RawSet(lua.LString("errors"), toTable(r.Errors))
+	return t
+}
+
+type managedProcess struct {
+	name     string
+	specHash string
+	cmd      *exec.Cmd
+	exited   chan struct{}
+}
+
+func (p *managedProcess) isRunning() bool {
+	select {
+	case <-p.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// reconcileJob is the manifest whose packages are installed in background
+type reconcileJob struct {
+	manifest *Manifest
+	result   *ReconcileResult
+}
+
+// Reconciler converges the device to the manifest delivered by the server
+type Reconciler struct {
+	workingDir string
+	manifest   *Manifest
+	httpClient *HTTPClient
+	// the invalid manifest is only logged once
+	rejectedVersion string
+
+	processes map[string]*managedProcess
+
+	// the packages are downloaded in a goroutine, the job is sent to done
+	// and finished in the agent loop, so the downloads do not block it
+	done    chan *reconcileJob
+	running bool
+	cancel  context.CancelFunc
+}
+
+func newReconciler(workingDir string, httpClient *HTTPClient) *Reconciler {
+	r := &Reconciler{
+		workingDir: workingDir,
+		httpClient: httpClient,
+		processes:  make(map[string]*managedProcess),
+		done:       make(chan *reconcileJob, 1),
+	}
+
+	m, err := loadManifest(workingDir)
+	if err == nil {
+		r.manifest = m
+	} else if !os.IsNotExist(err) {
+		log.Errorf("newReconciler load manifest failed:%v", err)
+	}
+
+	return r
+}
+
+func (r *Reconciler) setManifest(m *Manifest) {
+	if r.manifest != nil && r.manifest.Version == m.Version {
+		return
+	}
+
+	if err := m.validate(); err != nil {
+		if r.rejectedVersion != m.Version {
+			r.rejectedVersion = m.Version
+			log.Errorf("Reconciler reject manifest version %s:%v", m.Version, err)
+		}
+		return
+	}
+
+	log.Infof("Reconciler new manifest version %s", m.Version)
+	r.manifest = m
+
+	if err := saveManifest(r.workingDir, m); err != nil {
+		log.Errorf("Reconciler save manifest failed:%v", err)
+	}
+}
+
+// start install the packages of manifest in a goroutine, it does nothing
+// if the last job is not finished. The packages are verified by the trusted
+// keys of config
+func (r *Reconciler) start(config *AgentConfig) {
+	if r.running {
+		return
+	}
+
+	m := r.manifest
+	result := &ReconcileResult{ManifestVersion: m.Version, Time: time.Now().Unix()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), packageDownloadTimeout)
+	r.running = true
+	r.cancel = cancel
+
+	go func() {
+		defer cancel()
+		for _, pkg := range m.Packages {
+			r.reconcilePackage(ctx, pkg, config, result)
+		}
+		r.done <- &reconcileJob{manifest: m, result: result}
+	}()
+}
+
+// finish reconcile the files and processes after the packages installed,
+// it return nil if the manifest changed during the install
+func (r *Reconciler) finish(job *reconcileJob) *ReconcileResult {
+	r.running = false
+	r.cancel = nil
+	if job.manifest != r.manifest {
+		return nil
+	}
+
+	m := r.manifest
+	result := job.result
+	for _, f := range m.Files {
+		r.reconcileFile(f, result)
+	}
+
+	// do not touch processes with a half installed package set
+	if len(result.Errors) > 0 {
+		return result
+	}
+
+	r.reconcileProcesses(result)
+	r.removeStalePackages()
+
+	return result
+}
+
+// reconcilePackage run in the goroutine of start, it only touch the result
+// and the package dir
+func (r *Reconciler) reconcilePackage(ctx context.Context, pkg *ManifestPackage, config *AgentConfig, result *ReconcileResult) {
+	dir := packageDir(r.workingDir, pkg)
+	marker := path.Join(dir, ".md5")
+
+	buf, err := os.ReadFile(marker)
+	if err == nil && string(buf) == pkg.MD5 {
+		return
+	}
+
+	result.drift("package %s %s not installed", pkg.Name, pkg.Version)
+
+	downloadPath := dir + ".download"
+	err = os.MkdirAll(path.Dir(dir), os.ModePerm)
+	if err != nil {
+		result.error("package %s mkdir failed:%v", pkg.Name, err)
+		return
+	}
+	defer os.Remove(downloadPath)
+
+	downloader := &Downloader{tag: pkg.Name, ctx: ctx, client: r.httpClient}
+	err = downloader.donwloadFile(downloadPath, pkg.URL)
+	if err != nil {
+		result.error("package %s download failed:%v", pkg.Name, err)
+		return
+	}
+
+	md5, err := fileMD5(downloadPath)
+	if err != nil {
+		result.error("package %s md5 failed:%v", pkg.Name, err)
+		return
+	}
+
+	if md5 != pkg.MD5 {
+		result.error("package %s md5 not match, expect %s, got %s", pkg.Name, pkg.MD5, md5)
+		return
+	}
+
+	buf, err = os.ReadFile(downloadPath)
+	if err == nil {
+		err = config.verifyScript(buf, pkg.Signature)
+	}
+	if err != nil {
+		result.error("package %s verify failed:%v", pkg.Name, err)
+		return
+	}
+
+	os.RemoveAll(dir)
+	switch {
+	case strings.HasSuffix(pkg.URL, ".zip"):
+		err = extractZip(downloadPath, dir)
+	case strings.HasSuffix(pkg.URL, ".7z"):
+		err = extract7z(downloadPath, dir)
+	default:
+		err = os.MkdirAll(dir, os.ModePerm)
+		if err == nil {
+			err = copyFile(downloadPath, path.Join(dir, path.Base(pkg.URL)))
+		}
+	}
+
+	if err != nil {
+		result.error("package %s install failed:%v", pkg.Name, err)
+		return
+	}
+
+	err = os.WriteFile(marker, []byte(pkg.MD5), 0644)
+	if err != nil {
+		result.error("package %s write marker failed:%v", pkg.Name, err)
+		return
+	}
+
+	result.action("install package %s %s", pkg.Name, pkg.Version)
+}
+
+func (r *Reconciler) reconcileFile(f *ManifestFile, result *ReconcileResult) {
+	// the path is checked by validate, a symlink must not lead it out
+	filePath := path.Join(r.workingDir, f.Path)
+	if !isUnderDir(filePath, r.workingDir) {
+		result.error("file %s is outside of working dir", f.Path)
+		return
+	}
+
+	mode := int64(0644)
+	if len(f.Mode) > 0 {
+		var err error
+		mode, err = strconv.ParseInt(f.Mode, 8, 64)
+		if err != nil {
+			result.error("file %s parse mode failed:%v", f.Path, err)
+			return
+		}
+	}
+
+	buf, err := os.ReadFile(filePath)
+	if err == nil && string(buf) == f.Content {
+		return
+	}
+
+	result.drift("file %s content differs", f.Path)
+
+	err = os.MkdirAll(path.Dir(filePath), os.ModePerm)
+	if err == nil {
+		err = os.WriteFile(filePath, []byte(f.Content), fs.FileMode(mode))
+	}
+
+	if err != nil {
+		result.error("file %s write failed:%v", f.Path, err)
+		return
+	}
+
+	result.action("write file %s", f.Path)
+}
+
+func (r *Reconciler) reconcileProcesses(result *ReconcileResult) {
+	m := r.manifest
+	desired := make(map[string]*ManifestProcess)
+	for _, p := range m.Processes {
+		desired[p.Name] = r.expandProcess(p)
+	}
+
+	for name, p := range r.processes {
+		spec, ok := desired[name]
+		if ok && spec.specHash() == p.specHash {
+			continue
+		}
+
+		if p.isRunning() {
+			p.cmd.Process.Kill()
+			<-p.exited
+			result.action("stop process %s", name)
+		}
+		delete(r.processes, name)
+	}
+
+	for name, spec := range desired {
+		p, ok := r.processes[name]
+		if ok && p.isRunning() {
+			continue
+		}
+
+		if ok {
+			result.drift("process %s not running", name)
+		} else {
+			result.drift("process %s not started", name)
+		}
+
+		p, err := r.startProcess(spec)
+		if err != nil {
+			result.error("process %s start failed:%v", name, err)
+			continue
+		}
+
+		r.processes[name] = p
+		result.action("start process %s", name)
+	}
+}
+
+func (r *Reconciler) expandProcess(p *ManifestProcess) *ManifestProcess {
+	expand := func(s string) string {
+		return r.manifest.expand(s, r.workingDir)
+	}
+
+	spec := &ManifestProcess{
+		Name: p.Name,
+		Path: expand(p.Path),
+		Dir:  expand(p.Dir),
+	}
+
+	for _, arg := range p.Args {
+		spec.Args = append(spec.Args, expand(arg))
+	}
+
+	for _, env := range p.Env {
+		spec.Env = append(spec.Env, expand(env))
+	}
+
+	return spec
+}
+
+func (r *Reconciler) startProcess(spec *ManifestProcess) (*managedProcess, error) {
+	cmd := exec.Command(spec.Path, spec.Args...)
+	cmd.Env = append(os.Environ(), spec.Env...)
+	cmd.Dir = spec.Dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &managedProcess{
+		name:     spec.Name,
+		specHash: spec.specHash(),
+		cmd:      cmd,
+		exited:   make(chan struct{}),
+	}
+
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			log.Errorf("managed process %s exit, err:%v", p.name, err)
+		}
+		close(p.exited)
+	}()
+
+	return p, nil
+}
+
+// removeStalePackages removes packages and package versions no longer in manifest
+func (r *Reconciler) removeStalePackages() {
+	packagesDir := path.Join(r.workingDir, "packages")
+	names, err := os.ReadDir(packagesDir)
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		pkg := r.manifest.getPackage(name.Name())
+		if pkg == nil {
+			os.RemoveAll(path.Join(packagesDir, name.Name()))
+			continue
+		}
+
+		versions, err := os.ReadDir(path.Join(packagesDir, name.Name()))
+		if err != nil {
+			continue
+		}
+
+		for _, v := range versions {
+			if v.Name() != pkg.Version {
+				os.RemoveAll(path.Join(packagesDir, name.Name(), v.Name()))
+			}
+		}
+	}
+}
+
+func (r *Reconciler) stop() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+
+	for _, p := range r.processes {
+		if p.isRunning() {
+			p.cmd.Process.Kill()
+		}
+	}
+
+	r.processes = make(map[string]*managedProcess)
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+func reexec(exe string) error {
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+)
+
+// windows can not replace the running process, start a new one and exit
+func reexec(exe string) error {
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = os.Environ()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	os.Exit(0)
+	return nil
+}
@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// serverEndpoint returns the url of path on the same host as the active server
+func (a *Agent) serverEndpoint(p string) (string, error) {
+	u, err := url.Parse(a.serverURL())
+	if err != nil {
+		return "", err
+	}
+
+	u.Path = p
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// report post a json payload of kind to the server
+func (a *Agent) report(kind string, payload interface{}) error {
+	if len(a.enrollment.Status) > 0 && !a.isEnrolled() {
+		return fmt.Errorf("device not enrolled")
+	}
+
+	endpoint, err := a.serverEndpoint("/report/" + kind)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Add("uuid", a.devInfo.UUID)
+	endpoint = fmt.Sprintf("%s?%s", endpoint, query.Encode())
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.httpClient.Timeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("report %s status code: %d, msg: %s", kind, resp.StatusCode, string(body))
+	}
+
+	return nil
+}
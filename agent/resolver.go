@@ -0,0 +1,385 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsCacheFileName = "dns-cache.json"
+	dnsTimeout       = 5 * time.Second
+	dohContentType   = "application/dns-message"
+	maxDoHRespSize   = 64 * 1024
+)
+
+// DNSConfig set how the agent resolve host names, the system resolver is
+// used if neither Servers nor DoH is set
+type DNSConfig struct {
+	// udp dns servers, e.g. 8.8.8.8:53
+	Servers []string `json:"servers,omitempty"`
+	// dns over https url, e.g. https://1.1.1.1/dns-query
+	DoH string `json:"doh,omitempty"`
+	// static host overrides, host name to ips
+	Hosts map[string][]string `json:"hosts,omitempty"`
+}
+
+type dnsCacheEntry struct {
+	IPs  []string `json:"ips"`
+	Time int64    `json:"time"`
+}
+
+// Resolver resolve host names for the agent connections and Lua, the
+// last good ips are saved in working dir and used when lookup failed
+type Resolver struct {
+	lock      sync.RWMutex
+	config    *DNSConfig
+	resolver  *net.Resolver
+	dohClient *http.Client
+
+	cacheLock sync.Mutex
+	cacheFile string
+	cache     map[string]*dnsCacheEntry
+}
+
+func newResolver(workingDir string) *Resolver {
+	r := &Resolver{
+		config:    &DNSConfig{},
+		resolver:  net.DefaultResolver,
+		cacheFile: path.Join(workingDir, dnsCacheFileName),
+		cache:     make(map[string]*dnsCacheEntry),
+	}
+
+	buf, err := os.ReadFile(r.cacheFile)
+	if err == nil {
+		err = json.Unmarshal(buf, &r.cache)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("newResolver load dns cache failed:%v", err)
+	}
+
+	return r
+}
+
+// update apply the dns config, transport and dialer are used by the DoH requests
+func (r *Resolver) update(config *DNSConfig, transport *http.Transport, dialer *net.Dialer) error {
+	if config == nil {
+		config = &DNSConfig{}
+	}
+
+	for _, server := range config.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return fmt.Errorf("invalid dns server %s:%v", server, err)
+		}
+	}
+
+	for host, ips := range config.Hosts {
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("invalid ip %s of host %s", ip, host)
+			}
+		}
+	}
+
+	resolver := net.DefaultResolver
+	if len(config.Servers) > 0 {
+		servers := config.Servers
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{Timeout: dnsTimeout}
+				return d.DialContext(ctx, network, servers[rand.Intn(len(servers))])
+			},
+		}
+	}
+
+	var dohClient *http.Client
+	if len(config.DoH) > 0 {
+		if !strings.HasPrefix(config.DoH, "https://") {
+			return fmt.Errorf("invalid doh url %s", config.DoH)
+		}
+
+		// the doh server itself is resolved by hosts or the system resolver
+		t := transport.Clone()
+		t.DialContext = r.dialContext(dialer, false)
+		dohClient = &http.Client{Transport: t, Timeout: dnsTimeout}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !reflect.DeepEqual(r.config, config) {
+		log.Infof("apply dns config, servers %v, doh %s, hosts %d", config.Servers, config.DoH, len(config.Hosts))
+	}
+
+	r.config = config
+	r.resolver = resolver
+	r.dohClient = dohClient
+
+	return nil
+}
+
+// LookupHost return the ips of host, it try the static hosts, the
+// configured resolver and then the cache
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return r.lookupHost(ctx, host, true)
+}
+
+func (r *Resolver) lookupHost(ctx context.Context, host string, useDoH bool) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	r.lock.RLock()
+	config, resolver, dohClient := r.config, r.resolver, r.dohClient
+	r.lock.RUnlock()
+
+	if ips, ok := config.Hosts[host]; ok && len(ips) > 0 {
+		return ips, nil
+	}
+
+	var ips []string
+	var err error
+	if useDoH && dohClient != nil {
+		ips, err = lookupDoH(ctx, dohClient, config.DoH, host)
+	} else {
+		ips, err = resolver.LookupHost(ctx, host)
+	}
+
+	if err == nil && len(ips) > 0 {
+		r.saveCache(host, ips)
+		return ips, nil
+	}
+
+	if err == nil {
+		err = fmt.Errorf("no address of host %s", host)
+	}
+
+	cached := r.loadCache(host)
+	if len(cached) > 0 {
+		log.Warnf("lookup %s failed:%v, use the cached ips %v", host, err, cached)
+		return cached, nil
+	}
+
+	return nil, err
+}
+
+// LookupSRV return the srv records of name with the configured dns
+// servers or DoH, the targets are resolved by LookupHost when dialed
+func (r *Resolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	r.lock.RLock()
+	config, resolver, dohClient := r.config, r.resolver, r.dohClient
+	r.lock.RUnlock()
+
+	if dohClient != nil {
+		return lookupDoHSRV(ctx, dohClient, config.DoH, name)
+	}
+
+	// records are sorted by priority and randomized by weight
+	_, records, err := resolver.LookupSRV(ctx, "", "", name)
+	return records, err
+}
+
+// dialContext return a dial function for http transport which resolve
+// the address with r and try the ips in order
+func (r *Resolver) dialContext(dialer *net.Dialer, useDoH bool) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		ips, err := r.lookupHost(ctx, host, useDoH)
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error
+		for _, ip := range ips {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+
+		return nil, lastErr
+	}
+}
+
+func (r *Resolver) loadCache(host string) []string {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+
+	entry := r.cache[host]
+	if entry == nil {
+		return nil
+	}
+	return entry.IPs
+}
+
+func (r *Resolver) saveCache(host string, ips []string) {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+
+	entry := r.cache[host]
+	if entry != nil && reflect.DeepEqual(entry.IPs, ips) {
+		return
+	}
+
+	r.cache[host] = &dnsCacheEntry{IPs: ips, Time: time.Now().Unix()}
+
+	buf, err := json.MarshalIndent(r.cache, "", "  ")
+	if err != nil {
+		log.Errorf("saveCache marshal failed:%v", err)
+		return
+	}
+
+	err = os.WriteFile(r.cacheFile, buf, 0644)
+	if err != nil {
+		log.Errorf("saveCache write file failed:%v", err)
+	}
+}
+
+// lookupDoH query the A and AAAA records with RFC 8484 GET request
+func lookupDoH(ctx context.Context, client *http.Client, dohURL string, host string) ([]string, error) {
+	ips := make([]string, 0)
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		result, err := queryDoH(ctx, client, dohURL, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ips = append(ips, result...)
+	}
+
+	if len(ips) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	return ips, nil
+}
+
+func queryDoH(ctx context.Context, client *http.Client, dohURL string, host string, qtype dnsmessage.Type) ([]string, error) {
+	answer, err := exchangeDoH(ctx, client, dohURL, host, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]string, 0)
+	for _, a := range answer.Answers {
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]).String())
+		}
+	}
+
+	return ips, nil
+}
+
+// lookupDoHSRV return the srv records of name sorted by priority, the
+// records of same priority are sorted by weight
+func lookupDoHSRV(ctx context.Context, client *http.Client, dohURL string, name string) ([]*net.SRV, error) {
+	answer, err := exchangeDoH(ctx, client, dohURL, name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*net.SRV, 0)
+	for _, a := range answer.Answers {
+		if body, ok := a.Body.(*dnsmessage.SRVResource); ok {
+			records = append(records, &net.SRV{Target: body.Target.String(), Port: body.Port, Priority: body.Priority, Weight: body.Weight})
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Priority != records[j].Priority {
+			return records[i].Priority < records[j].Priority
+		}
+		return records[i].Weight > records[j].Weight
+	})
+
+	return records, nil
+}
+
+func exchangeDoH(ctx context.Context, client *http.Client, dohURL string, host string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	name, err := dnsmessage.NewName(dnsName(host))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dnsmessage.Message{
+		// id should be 0 for http cache
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s?dns=%s", dohURL, base64.RawURLEncoding.EncodeToString(query))
+	if strings.Contains(dohURL, "?") {
+		url = fmt.Sprintf("%s&dns=%s", dohURL, base64.RawURLEncoding.EncodeToString(query))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDoHRespSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("doh status code: %d, msg: %s", resp.StatusCode, string(bytes.TrimSpace(body)))
+	}
+
+	answer := &dnsmessage.Message{}
+	err = answer.Unpack(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if answer.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("doh lookup %s failed: %s", host, answer.RCode.String())
+	}
+
+	return answer, nil
+}
+
+func dnsName(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+	return host + "."
+}
@@ -0,0 +1,376 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// modules of agent, they check the capabilities by themselves
+var agentModules = []string{"agent", "timer", "downloader", "process", "httpc"}
+
+// trustedPath is searched for the commands without dir, PATH of agent is
+// not used as scripts can change it with os.setenv
+var trustedPath = defaultTrustedPath()
+
+func defaultTrustedPath() []string {
+	if runtime.GOOS == "windows" {
+		root := os.Getenv("SystemRoot")
+		if len(root) == 0 {
+			root = `C:\Windows`
+		}
+		return []string{filepath.Join(root, "System32"), root, filepath.Join(root, "System32", "WindowsPowerShell", "v1.0")}
+	}
+	return []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+}
+
+// Capabilities declare what the script is allowed to do, scripts without
+// capabilities are not restricted. Modules of gopher-lua-libs are allowed
+// as a whole, e.g. "cmd" or "http" bypass the exec and hosts checks
+type Capabilities struct {
+	// lua modules can be required besides the agent modules
+	Modules []string `json:"modules,omitempty"`
+	// binaries can be executed, absolute paths or names found in the
+	// system dirs, the command is matched by the binary it resolve to
+	Exec []string `json:"exec,omitempty"`
+	// directories can be accessed, relative to working dir, default the working dir
+	Paths []string `json:"paths,omitempty"`
+	// hosts can be accessed, "*.example.com" match the subdomains
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// sandbox enforce the capabilities of a script, nil sandbox allow all
+type sandbox struct {
+	scriptMD5 string
+	caps      *Capabilities
+	paths     []string
+}
+
+type sandboxKey struct{}
+
+func newSandbox(config *ScriptConfig, workingDir string, scriptMD5 string) *sandbox {
+	if config == nil || config.Capabilities == nil {
+		return nil
+	}
+
+	caps := config.Capabilities
+	sb := &sandbox{scriptMD5: scriptMD5, caps: caps}
+
+	paths := caps.Paths
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(workingDir, p)
+		}
+		sb.paths = append(sb.paths, realPath(p))
+	}
+
+	return sb
+}
+
+// realPath return the absolute path with symlinks resolved, the missing
+// part of the path is kept as it is
+func realPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return filepath.Clean(p)
+	}
+
+	dir, rest := abs, ""
+	for {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(real, rest)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return abs
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = parent
+	}
+}
+
+func (sb *sandbox) deny(format string, args ...interface{}) error {
+	err := fmt.Errorf("%s denied by script capabilities", fmt.Sprintf(format, args...))
+	log.Warnf("script %s %s", sb.scriptMD5, err.Error())
+	return err
+}
+
+func (sb *sandbox) allowModule(name string) bool {
+	if sb == nil {
+		return true
+	}
+
+	for _, m := range agentModules {
+		if m == name {
+			return true
+		}
+	}
+
+	for _, m := range sb.caps.Modules {
+		if m == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkExec check the binary of the command, the command is split by
+// spaces as agent.exec does. It return the command with the binary
+// replaced by its resolved path, so the checked binary is executed
+func (sb *sandbox) checkExec(command string) (string, error) {
+	if sb == nil {
+		return command, nil
+	}
+
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return command, nil
+	}
+
+	bin := fields[0]
+	resolved, ok := resolveExec(bin, true)
+	if !ok {
+		return "", sb.deny("exec %s", bin)
+	}
+
+	for _, allowed := range sb.caps.Exec {
+		if p, ok := resolveExec(allowed, false); ok && samePath(p, resolved) {
+			return strings.Replace(command, bin, resolved, 1), nil
+		}
+	}
+
+	return "", sb.deny("exec %s", bin)
+}
+
+// resolveExec return the real path of the binary, names without dir are
+// searched in trusted path, relative paths are only accepted for commands
+func resolveExec(name string, relative bool) (string, bool) {
+	if filepath.IsAbs(name) || (relative && strings.ContainsAny(name, `/\`)) {
+		return findExecutable(name)
+	}
+
+	if strings.ContainsAny(name, `/\`) {
+		return "", false
+	}
+
+	for _, dir := range trustedPath {
+		if p, ok := findExecutable(filepath.Join(dir, name)); ok {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// findExecutable return the real path of p if it is a regular file, the
+// .exe suffix can be omitted on windows
+func findExecutable(p string) (string, bool) {
+	candidates := []string{p}
+	if runtime.GOOS == "windows" && len(filepath.Ext(p)) == 0 {
+		candidates = append(candidates, p+".exe")
+	}
+
+	for _, c := range candidates {
+		real := realPath(c)
+		if info, err := os.Stat(real); err == nil && info.Mode().IsRegular() {
+			return real, true
+		}
+	}
+	return "", false
+}
+
+func samePath(a, b string) bool {
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+func (sb *sandbox) checkPath(p string) error {
+	if sb == nil {
+		return nil
+	}
+
+	real := realPath(p)
+	for _, root := range sb.paths {
+		if real == root || strings.HasPrefix(real, root+string(filepath.Separator)) {
+			return nil
+		}
+	}
+
+	return sb.deny("path %s", p)
+}
+
+func (sb *sandbox) checkHost(host string) error {
+	if sb == nil {
+		return nil
+	}
+
+	host = strings.ToLower(host)
+	for _, allowed := range sb.caps.Hosts {
+		allowed = strings.ToLower(allowed)
+		if allowed == host {
+			return nil
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return nil
+		}
+	}
+
+	return sb.deny("host %s", host)
+}
+
+func (sb *sandbox) checkURL(rawURL string) error {
+	if sb == nil {
+		return nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	return sb.checkHost(u.Hostname())
+}
+
+// withContext attach the sandbox to the request context so the redirects
+// are checked by HTTPClient
+func (sb *sandbox) withContext(ctx context.Context) context.Context {
+	if sb == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, sandboxKey{}, sb)
+}
+
+// checkRedirect is the CheckRedirect of agent http client
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	if sb, ok := req.Context().Value(sandboxKey{}).(*sandbox); ok {
+		return sb.checkHost(req.URL.Hostname())
+	}
+	return nil
+}
+
+// restrictModules replace the preloaded modules not declared by the script
+func (sb *sandbox) restrictModules(L *lua.LState) {
+	if sb == nil {
+		return
+	}
+
+	preload, ok := L.GetField(L.GetGlobal("package"), "preload").(*lua.LTable)
+	if !ok {
+		return
+	}
+
+	denied := []string{}
+	preload.ForEach(func(k, v lua.LValue) {
+		if name, ok := k.(lua.LString); ok && !sb.allowModule(string(name)) {
+			denied = append(denied, string(name))
+		}
+	})
+
+	for _, name := range denied {
+		name := name
+		preload.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+			L.RaiseError("%v", sb.deny("module %s", name))
+			return 0
+		}))
+	}
+}
+
+// restrictStdlib check the file access of lua standard library and remove
+// the functions running shell or exiting the agent
+func (sb *sandbox) restrictStdlib(L *lua.LState) {
+	if sb == nil {
+		return
+	}
+
+	denyFunc := func(name string) *lua.LFunction {
+		return L.NewFunction(func(L *lua.LState) int {
+			L.RaiseError("%v", sb.deny("%s", name))
+			return 0
+		})
+	}
+
+	// check the string arguments at the positions as paths
+	checkPaths := func(t lua.LValue, name string, positions ...int) {
+		orig, ok := L.GetField(t, name).(*lua.LFunction)
+		if !ok {
+			return
+		}
+
+		L.SetField(t, name, L.NewFunction(func(L *lua.LState) int {
+			for _, n := range positions {
+				if p, ok := L.Get(n).(lua.LString); ok {
+					if err := sb.checkPath(string(p)); err != nil {
+						L.RaiseError("%v", err)
+						return 0
+					}
+				}
+			}
+
+			top := L.GetTop()
+			L.Insert(orig, 1)
+			L.Call(top, lua.MultRet)
+			return L.GetTop()
+		}))
+	}
+
+	osLib := L.GetGlobal("os")
+	L.SetField(osLib, "execute", denyFunc("os.execute"))
+	L.SetField(osLib, "exit", denyFunc("os.exit"))
+	checkPaths(osLib, "remove", 1)
+	checkPaths(osLib, "rename", 1, 2)
+
+	ioLib := L.GetGlobal("io")
+	L.SetField(ioLib, "popen", denyFunc("io.popen"))
+	checkPaths(ioLib, "open", 1)
+	checkPaths(ioLib, "lines", 1)
+	checkPaths(ioLib, "input", 1)
+	checkPaths(ioLib, "output", 1)
+
+	global := L.Get(lua.GlobalsIndex)
+	checkPaths(global, "dofile", 1)
+	checkPaths(global, "loadfile", 1)
+
+	// lua modules are searched in the allowed paths only
+	patterns := make([]string, 0, len(sb.paths))
+	for _, p := range sb.paths {
+		patterns = append(patterns, filepath.Join(p, "?.lua"))
+	}
+	L.SetField(L.GetGlobal("package"), "path", lua.LString(strings.Join(patterns, ";")))
+}
+
+// checkPaths check the path arguments of agent functions
+func (s *Script) checkPaths(paths ...string) error {
+	for _, p := range paths {
+		if err := s.sandbox.checkPath(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDownload check the url and the file path of downloader
+func (s *Script) checkDownload(filePath, url string) error {
+	if err := s.sandbox.checkURL(url); err != nil {
+		return err
+	}
+	return s.checkPaths(filePath)
+}
@@ -1,6 +1,10 @@
 package agent
 
 import (
+	"context"
+	"errors"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 	libs "github.com/vadv/gopher-lua-libs"
 	lua "github.com/yuin/gopher-lua"
@@ -11,8 +15,11 @@ type ScriptEvent interface {
 }
 
 type Script struct {
-	agent   *Agent
+	host    *scriptHost
+	config  *ScriptConfig
 	fileMD5 string
+	// name of plugin, empty for the main script
+	name string
 
 	eventsChan chan ScriptEvent
 
@@ -25,6 +32,35 @@ type Script struct {
 	downloadModule *DownloadModule
 
 	processModule *ProcessModule
+
+	httpcModule *HTTPCModule
+
+	// coroutines started by agent.async, keyed by their thread
+	coroutines  map[*lua.LState]*coroutine
+	asyncCtx    context.Context
+	asyncCancel context.CancelFunc
+
+	// execution budget of a lua call and the number of calls exceeding it
+	callTimeout time.Duration
+	violations  int
+	startTime   time.Time
+
+	// limits of lua state, the script is unloaded once limitErr is set
+	options  lua.Options
+	maxHeap  int64
+	limitErr string
+	// the estimated heap is checked after lua calls at most once a interval
+	lastMemoryCheck time.Time
+
+	sandbox *sandbox
+	// unpacked dir of the bundle, empty for single file script
+	bundleDir string
+
+	// an update is deferred or rejected by the script, agent.readyForUpdate
+	// set updateReady only while it wait, then the deferred update is
+	// installed or the rejected one is offered again
+	updateWaiting bool
+	updateReady   bool
 }
 
 func (s *Script) events() <-chan ScriptEvent {
@@ -39,37 +75,79 @@ func (s *Script) handleEvent(evt ScriptEvent) {
 	switch evt.evtType() {
 	case "timer":
 		e := evt.(*TimerEvent)
-		if e != nil && s.timerModule.hasTimer(e.tag) {
-			s.callModFunction1(e.callback, lua.LString(e.tag))
+		if e != nil && s.timerModule.getTimer(e.tag) == e.timer {
+			s.callCallback(e.timer.callback, lua.LString(e.tag))
 		}
 	case "download":
 		e := evt.(*DownloadEvent)
-		if e != nil {
+		if e != nil && s.downloadModule.getDownloader(e.tag) == e.downloader {
 			s.downloadModule.delete(e.tag)
 			t := s.state.NewTable()
 			t.RawSet(lua.LString("tag"), lua.LString(e.tag))
 			t.RawSet(lua.LString("filePath"), lua.LString(e.filePath))
 			t.RawSet(lua.LString("md5"), lua.LString(e.md5))
 			t.RawSet(lua.LString("err"), lua.LString(e.err))
-			s.callModFunction1(e.callback, t)
+			if co := e.downloader.co; co != nil {
+				var err error
+				if len(e.err) > 0 {
+					err = errors.New(e.err)
+				}
+				s.resumeCoroutine(co, t, err)
+			} else {
+				s.callCallback(e.downloader.callback, t)
+			}
 		}
 	case "process":
 		e := evt.(*ProcessEvent)
-		if e != nil {
+		if e == nil {
+			return
+		}
+		t := s.state.NewTable()
+		t.RawSet(lua.LString("name"), lua.LString(e.name))
+		t.RawSet(lua.LString("exitCode"), lua.LNumber(e.exitCode))
+		t.RawSet(lua.LString("err"), lua.LString(e.err))
+		// killed processes are removed already but still wake up the waiters
+		if s.processModule.getProcess(e.name) == e.process {
 			s.processModule.delete(e.name)
+			s.callCallback(e.process.onExit, t)
+		}
+		waiters := e.process.waiters
+		e.process.waiters = nil
+		for _, co := range waiters {
+			s.resumeCoroutine(co, t, nil)
+		}
+	case "httpc":
+		e := evt.(*HTTPCEvent)
+		if e != nil {
+			s.httpcModule.handleEvent(e)
+		}
+	case "resume":
+		e := evt.(*ResumeEvent)
+		if e != nil {
+			result, err := e.result(s.state)
+			s.resumeCoroutine(e.co, result, err)
 		}
-
 	}
 }
 
-func newScript(agent *Agent, scriptFileMD5 string, fileContent []byte) *Script {
+// newScript create the script with the script config, plugins pass the
+// config they are started with
+func newScript(host *scriptHost, config *ScriptConfig, scriptFileMD5 string, fileContent []byte) *Script {
 	s := &Script{
-		agent:      agent,
+		host:       host,
+		config:     config,
 		fileMD5:    scriptFileMD5,
 		eventsChan: make(chan ScriptEvent, 64),
+		coroutines: make(map[*lua.LState]*coroutine),
+
+		callTimeout: config.callTimeout(),
 	}
+	s.asyncCtx, s.asyncCancel = context.WithCancel(context.Background())
 
-	s.state = lua.NewState()
+	s.options, s.maxHeap = config.luaOptions()
+	s.state = lua.NewState(s.options)
+	s.sandbox = newSandbox(config, host.workingDir, scriptFileMD5)
+	s.sandbox.restrictStdlib(s.state)
 
 	if len(fileContent) > 0 {
 		s.load(fileContent)
@@ -78,7 +156,10 @@ func newScript(agent *Agent, scriptFileMD5 string, fileContent []byte) *Script {
 	return s
 }
 
-func (s *Script) start() {
+// start the script with the state saved by the previous script, nil if
+// there is none
+func (s *Script) start(state []byte) {
+	s.startTime = time.Now()
 	ls := s.state
 	s.timerModule = newTimerModule(s)
 	ls.PreloadModule("timer", s.timerModule.loader)
@@ -86,60 +167,125 @@ func (s *Script) start() {
 	s.downloadModule = newDownloaderModule(s)
 	ls.PreloadModule("downloader", s.downloadModule.loader)
 
-	s.processModule = newProcessModule(s)
+	if s.processModule == nil {
+		s.processModule = newProcessModule(s)
+	}
 	ls.PreloadModule("process", s.processModule.loader)
 
-	ls.PreloadModule("agent", newAgentModule(s.agent).loader)
+	s.httpcModule = newHTTPCModule(s)
+	ls.PreloadModule("httpc", s.httpcModule.loader)
+
+	ls.PreloadModule("agent", newAgentModule(s).loader)
 
 	libs.Preload(ls)
+	s.sandbox.restrictModules(ls)
 
 	if s.modTable != nil {
 		// exec 'start' funciton in lua mod
-		s.callModFunction0("start")
+		s.callModFunction1("start", s.decodeState(state))
 	}
 }
 
 func (s *Script) hasLuaFunction(funcName string) bool {
 	if s.modTable != nil {
 		fn := s.state.GetField(s.modTable, funcName)
-		return fn != nil
+		return fn.Type() == lua.LTFunction
 	}
 
 	return false
 }
 
 func (s *Script) callModFunction0(funcName string) {
-	ls := s.state
-	fn := ls.GetField(s.modTable, funcName)
-	if fn != nil {
-		ls.Push(fn)
-		err := ls.PCall(0, lua.MultRet, nil)
-		if err != nil {
-			log.Errorf("callModFunction0 %s failed:%v", funcName, err)
-		}
+	if s.modTable != nil {
+		s.callFunction(funcName, s.state.GetField(s.modTable, funcName))
 	}
 }
 
 func (s *Script) callModFunction1(funcName string, param0 lua.LValue) {
-	ls := s.state
-	fn := ls.GetField(s.modTable, funcName)
-	if fn != nil {
+	if s.modTable != nil {
+		s.callFunction(funcName, s.state.GetField(s.modTable, funcName), param0)
+	}
+}
+
+// callFunction call fn if it is a function, the results are discarded
+func (s *Script) callFunction(name string, fn lua.LValue, args ...lua.LValue) {
+	if fn.Type() != lua.LTFunction {
+		return
+	}
+
+	s.withBudget(name, func() {
+		ls := s.state
 		ls.Push(fn)
-		ls.Push(param0)
-		err := ls.PCall(1, lua.MultRet, nil)
+		for _, arg := range args {
+			ls.Push(arg)
+		}
+
+		err := ls.PCall(len(args), 0, nil)
 		if err != nil {
-			log.Errorf("callModFunction1 %s failed:%v", funcName, err)
+			log.Errorf("call lua function %s failed:%v", name, err)
+			s.checkLimitError(err)
 		}
+	})
+}
+
+// callModResults call the mod function and return its nret results, it
+// return nil if the call fail
+func (s *Script) callModResults(funcName string, nret int, args ...lua.LValue) []lua.LValue {
+	if s.modTable == nil {
+		return nil
 	}
+
+	var rets []lua.LValue
+	s.withBudget(funcName, func() {
+		ls := s.state
+		ls.Push(ls.GetField(s.modTable, funcName))
+		for _, arg := range args {
+			ls.Push(arg)
+		}
+
+		err := ls.PCall(len(args), nret, nil)
+		if err != nil {
+			log.Errorf("call lua function %s failed:%v", funcName, err)
+			s.checkLimitError(err)
+			return
+		}
+
+		for i := -nret; i < 0; i++ {
+			rets = append(rets, ls.Get(i))
+		}
+		ls.Pop(nret)
+	})
+
+	return rets
 }
 
 func (s *Script) stop() {
+	s.close(false)
+}
+
+// handover close the script without calling its 'stop' function and keep
+// its processes running, the processes are controlled by the next script
+func (s *Script) handover(next *Script) {
+	pm := s.processModule
+	// exit events are pushed to next from now on
+	pm.setOwner(next)
+	s.close(true)
+
+	// exit callbacks belong to the closed lua state
+	pm.dropCallbacks()
+	pm.dropExited()
+	next.processModule = pm
+}
+
+func (s *Script) close(handover bool) {
 	ls := s.state
-	if s.modTable != nil {
+	if s.modTable != nil && !handover {
 		// exec 'stop' funciton in lua mod
 		s.callModFunction0("stop")
 	}
 
+	s.asyncCancel()
+	s.coroutines = nil
 	ls.Close()
 	s.state = nil
 	s.modTable = nil
@@ -147,22 +293,35 @@ func (s *Script) stop() {
 	s.timerModule = nil
 	s.downloadModule.clear()
 	s.downloadModule = nil
-	s.processModule.clear()
+	s.httpcModule.clear()
+	s.httpcModule = nil
+	if !handover {
+		s.processModule.clear()
+	}
 	s.processModule = nil
 }
 
 func (s *Script) load(fileContent []byte) {
 	ls := s.state
-	fn, err := ls.LoadString(string(fileContent))
+	var fn *lua.LFunction
+	var err error
+	if isBundle(fileContent) {
+		fn, err = s.loadBundle(fileContent)
+	} else {
+		fn, err = ls.LoadString(string(fileContent))
+	}
 	if err != nil {
 		log.Errorf("lstate load string failed:%v", err)
 		return
 	}
 
-	ls.Push(fn)
-	err = ls.PCall(0, lua.MultRet, nil)
+	s.withBudget("main chunk", func() {
+		ls.Push(fn)
+		err = ls.PCall(0, lua.MultRet, nil)
+	})
 	if err != nil {
 		log.Errorf("lstate PCall failed:%v", err)
+		s.checkLimitError(err)
 		return
 	}
 
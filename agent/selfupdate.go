@@ -0,0 +1,306 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	upgradeFileName = "upgrade.json"
+	// new agent binary must check in with server before timeout, otherwise rollback
+	upgradeConfirmTimeout = 3 * time.Minute
+)
+
+type AgentRelease struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	MD5     string `json:"md5"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	// base64 ed25519 signature of the binary by one of the trusted keys
+	Signature string `json:"signature,omitempty"`
+}
+
+// upgradeState is persisted in working dir while a new binary is on probation
+type upgradeState struct {
+	Version    string `json:"version"`
+	OldVersion string `json:"oldVersion"`
+	MD5        string `json:"md5"`
+	Exe        string `json:"exe"`
+	Backup     string `json:"backup"`
+	Deadline   int64  `json:"deadline"`
+	RolledBack bool   `json:"rolledBack"`
+}
+
+func (a *Agent) upgradeFilePath() string {
+	return path.Join(a.args.WorkingDir, upgradeFileName)
+}
+
+func loadUpgradeState(workingDir string) *upgradeState {
+	buf, err := os.ReadFile(path.Join(workingDir, upgradeFileName))
+	if err != nil {
+		return nil
+	}
+
+	state := &upgradeState{}
+	err = json.Unmarshal(buf, state)
+	if err != nil {
+		log.Errorf("loadUpgradeState unmarshal failed:%v", err)
+		return nil
+	}
+
+	return state
+}
+
+func saveUpgradeState(workingDir string, state *upgradeState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path.Join(workingDir, upgradeFileName), buf, 0644)
+}
+
+// checkUpgrade is called on startup, it rollback if the new binary
+// missed the deadline to check in with server
+func (a *Agent) checkUpgrade() {
+	state := loadUpgradeState(a.args.WorkingDir)
+	if state == nil || state.RolledBack {
+		return
+	}
+
+	if !a.isUpgradeRunning(state) {
+		// the new binary never started, keep the md5 so it will not be retried
+		log.Errorf("agent upgrade to %s not running, current version %s", state.Version, a.agentVersion)
+		restoreAgentBinary(state)
+		state.RolledBack = true
+		saveUpgradeState(a.args.WorkingDir, state)
+		return
+	}
+
+	if time.Now().Unix() > state.Deadline {
+		a.rollbackUpgrade(state)
+		return
+	}
+
+	a.pendingUpgrade = state
+}
+
+// isUpgradeRunning check the md5 of the running binary, the version is
+// only used if the binary can not be read
+func (a *Agent) isUpgradeRunning(state *upgradeState) bool {
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+
+	var md5 string
+	if err == nil {
+		md5, err = fileMD5(exe)
+	}
+	if err != nil {
+		log.Errorf("checkUpgrade get md5 of executable failed:%v", err)
+		return state.Version == a.agentVersion
+	}
+
+	return md5 == state.MD5
+}
+
+// restoreAgentBinary put the backup back if the binary was swapped, and
+// remove the staged binary left by an interrupted upgrade
+func restoreAgentBinary(state *upgradeState) {
+	os.Remove(state.stagedExe())
+
+	if _, err := os.Stat(state.Backup); err != nil {
+		return
+	}
+
+	err := os.Rename(state.Backup, state.Exe)
+	if err != nil {
+		log.Errorf("restore agent binary failed:%v", err)
+	}
+}
+
+// confirmUpgrade is called after every successful check in
+func (a *Agent) confirmUpgrade() {
+	state := a.pendingUpgrade
+	if state == nil {
+		return
+	}
+
+	log.Infof("agent upgrade from %s to %s confirmed", state.OldVersion, state.Version)
+	os.Remove(state.Backup)
+	os.Remove(a.upgradeFilePath())
+	a.pendingUpgrade = nil
+}
+
+func (a *Agent) upgradeDeadline() <-chan time.Time {
+	if a.pendingUpgrade == nil {
+		return nil
+	}
+
+	return time.After(time.Until(time.Unix(a.pendingUpgrade.Deadline, 0)))
+}
+
+func (a *Agent) rollbackUpgrade(state *upgradeState) {
+	log.Errorf("agent %s did not check in before deadline, rollback to %s", state.Version, state.OldVersion)
+
+	err := os.Rename(state.Backup, state.Exe)
+	if err != nil {
+		log.Errorf("rollback agent binary failed:%v", err)
+		return
+	}
+
+	state.RolledBack = true
+	saveUpgradeState(a.args.WorkingDir, state)
+	a.pendingUpgrade = nil
+
+	a.reexec(state.Exe)
+}
+
+// upgradeAgent download the release and exit, the supervisor swap the
+// binary and restart the agent. The release must be signed by the trusted
+// keys, and only the supervised agent is upgraded, since the supervisor
+// roll back the binary which can not start
+func (a *Agent) upgradeAgent(release *AgentRelease) {
+	if release.Version == a.agentVersion || a.pendingUpgrade != nil {
+		return
+	}
+
+	state := loadUpgradeState(a.args.WorkingDir)
+	if state != nil && state.RolledBack && state.MD5 == release.MD5 {
+		return
+	}
+
+	if !isSupervised() {
+		log.Warnf("upgradeAgent skip %s, agent is not run by supervisor", release.Version)
+		return
+	}
+
+	if len(a.config.TrustedKeys) == 0 || len(release.Signature) == 0 {
+		log.Warnf("upgradeAgent skip %s, release must be signed by trusted keys", release.Version)
+		return
+	}
+
+	log.Infof("upgrade agent from %s to %s", a.agentVersion, release.Version)
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		log.Errorf("upgradeAgent get executable failed:%v", err)
+		return
+	}
+
+	state = &upgradeState{
+		Version:    release.Version,
+		OldVersion: a.agentVersion,
+		MD5:        release.MD5,
+		Exe:        exe,
+		Backup:     exe + ".old",
+	}
+
+	// download next to the binary so the rename is atomic
+	err = a.downloadAgent(release, state.stagedExe())
+	if err != nil {
+		os.Remove(state.stagedExe())
+		log.Errorf("upgradeAgent download failed:%v", err)
+		return
+	}
+
+	err = saveUpgradeState(a.args.WorkingDir, state)
+	if err != nil {
+		log.Errorf("upgradeAgent save state failed:%v", err)
+		return
+	}
+
+	a.reexec(exe)
+}
+
+func (state *upgradeState) stagedExe() string {
+	return state.Exe + ".new"
+}
+
+// swapAgentBinary replace the agent binary with the staged one and start the probation
+func swapAgentBinary(workingDir string, state *upgradeState) error {
+	upgradeFile := path.Join(workingDir, upgradeFileName)
+
+	err := os.Rename(state.Exe, state.Backup)
+	if err != nil {
+		os.Remove(upgradeFile)
+		return err
+	}
+
+	err = os.Rename(state.stagedExe(), state.Exe)
+	if err != nil {
+		os.Rename(state.Backup, state.Exe)
+		os.Remove(upgradeFile)
+		return err
+	}
+
+	state.Deadline = time.Now().Add(upgradeConfirmTimeout).Unix()
+	return saveUpgradeState(workingDir, state)
+}
+
+func (a *Agent) downloadAgent(release *AgentRelease, filePath string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), packageDownloadTimeout)
+	defer cancel()
+
+	downloader := &Downloader{tag: "agent", ctx: ctx, client: a.httpClient}
+	err := downloader.donwloadFile(filePath, release.URL)
+	if err != nil {
+		return err
+	}
+
+	md5, err := fileMD5(filePath)
+	if err != nil {
+		return err
+	}
+
+	if md5 != release.MD5 {
+		return fmt.Errorf("agent binary md5 not match, expect %s, got %s", release.MD5, md5)
+	}
+
+	buf, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	err = a.config.verifySignature(buf, release.Signature)
+	if err != nil {
+		return fmt.Errorf("verify agent binary failed:%v", err)
+	}
+
+	return os.Chmod(filePath, 0755)
+}
+
+// reexec stop everything the agent manage and replace the process with exe,
+// under supervisor the agent just exit and let the supervisor restart it
+func (a *Agent) reexec(exe string) {
+	if a.script != nil {
+		a.persistScriptState()
+		a.script.stop()
+		a.script = nil
+	}
+	a.stopPlugins(true)
+	a.reconciler.stop()
+
+	if isSupervised() {
+		log.Info("agent exit for restart by supervisor")
+		os.Exit(exitCodeRestart)
+	}
+
+	err := reexec(exe)
+	if err != nil {
+		log.Errorf("re-exec %s failed:%v", exe, err)
+		os.Exit(1)
+	}
+}
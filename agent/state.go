@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	lj "github.com/vadv/gopher-lua-libs/json"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	scriptStateFileName = "script-state.json"
+	pluginStateSuffix   = ".state.json"
+)
+
+// savedState is the state of the stopped script in working dir, it is
+// passed to the next script started after the agent restart
+type savedState struct {
+	MD5   string          `json:"md5"`
+	Time  int64           `json:"time"`
+	State json.RawMessage `json:"state"`
+}
+
+// saveState call mod.saveState and return its result as json, ok is false
+// if the script does not implement it. The state is null if it fail
+func (s *Script) saveState() (state []byte, ok bool) {
+	if s == nil || s.state == nil || !s.hasLuaFunction("saveState") {
+		return nil, false
+	}
+
+	var value lua.LValue = lua.LNil
+	if rets := s.callModResults("saveState", 1); rets != nil {
+		value = rets[0]
+	}
+
+	buf, err := lj.ValueEncode(value)
+	if err != nil {
+		log.Errorf("encode script state failed:%v", err)
+		return []byte("null"), true
+	}
+
+	return buf, true
+}
+
+// decodeState return the lua value of state saved by the previous script
+func (s *Script) decodeState(state []byte) lua.LValue {
+	if len(state) == 0 {
+		return lua.LNil
+	}
+
+	v, err := lj.ValueDecode(s.state, state)
+	if err != nil {
+		log.Errorf("decode script state failed:%v", err)
+		return lua.LNil
+	}
+	return v
+}
+
+// writeState keep the state for the script started after agent restart
+func writeState(filePath string, md5 string, state []byte) {
+	buf, err := json.Marshal(&savedState{MD5: md5, Time: time.Now().Unix(), State: state})
+	if err != nil {
+		log.Errorf("marshal script state failed:%v", err)
+		return
+	}
+
+	err = os.WriteFile(filePath, buf, 0644)
+	if err != nil {
+		log.Errorf("write script state failed:%v", err)
+	}
+}
+
+// takeState read and remove the saved state, so it is passed only once
+func takeState(filePath string) []byte {
+	buf, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil
+	}
+	os.Remove(filePath)
+
+	saved := &savedState{}
+	if err := json.Unmarshal(buf, saved); err != nil {
+		log.Errorf("load script state failed:%v", err)
+		return nil
+	}
+
+	log.Infof("load state saved by script %s at %s", saved.MD5, time.Unix(saved.Time, 0).Format(time.RFC3339))
+	return saved.State
+}
+
+func (a *Agent) scriptStatePath() string {
+	return path.Join(a.args.WorkingDir, scriptStateFileName)
+}
+
+func pluginStatePath(workingDir, name string) string {
+	return path.Join(workingDir, pluginDirName, name+pluginStateSuffix)
+}
+
+// persistScriptState save the state of main script before the agent exit
+func (a *Agent) persistScriptState() {
+	if state, ok := a.script.saveState(); ok {
+		writeState(a.scriptStatePath(), a.script.fileMD5, state)
+	}
+}
@@ -0,0 +1,260 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	supervisedEnv = "TITAN_AGENT_SUPERVISED"
+	// agent exit with this code to ask supervisor restart it immediately
+	exitCodeRestart = 3
+
+	lastCrashFileName = "last-crash.log"
+	crashLogSize      = 64 * 1024
+
+	minRestartBackoff = time.Second
+	maxRestartBackoff = time.Minute
+	// agent run longer than this is considered as stable, reset the backoff
+	stableRunTime = time.Minute
+)
+
+func isSupervised() bool {
+	return os.Getenv(supervisedEnv) == "1"
+}
+
+// Supervisor run the agent as a child process and restart it when it exit
+type Supervisor struct {
+	workingDir string
+	args       []string
+	// path of agent binary, resolved once as /proc/self/exe follow the
+	// renamed file after the binary is swapped
+	exe string
+
+	lock    sync.Mutex
+	process *os.Process
+}
+
+func NewSupervisor(workingDir string, args []string) *Supervisor {
+	return &Supervisor{workingDir: workingDir, args: args}
+}
+
+func (s *Supervisor) Run(ctx context.Context) error {
+	err := os.MkdirAll(s.workingDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	s.exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return err
+	}
+
+	backoff := minRestartBackoff
+	for {
+		startTime := time.Now()
+		exitCode, output, err := s.runAgent(ctx)
+		if ctx.Err() != nil {
+			log.Info("ctx done, supervisor will quit")
+			return nil
+		}
+
+		if err != nil {
+			log.Errorf("supervisor run agent failed:%v", err)
+		} else if exitCode != exitCodeRestart {
+			log.Errorf("agent exit with code %d", exitCode)
+			s.saveCrashLog(exitCode, output)
+		}
+
+		s.checkUpgrade(exitCode != exitCodeRestart)
+
+		if err == nil && exitCode == exitCodeRestart {
+			backoff = minRestartBackoff
+			continue
+		}
+
+		if time.Since(startTime) > stableRunTime {
+			backoff = minRestartBackoff
+		}
+
+		log.Infof("supervisor restart agent after %s", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil
+		}
+
+		backoff = backoff * 2
+		if backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+func (s *Supervisor) runAgent(ctx context.Context) (int, []byte, error) {
+	output := &tailBuffer{size: crashLogSize}
+	cmd := exec.Command(s.exe, s.args...)
+	cmd.Env = append(os.Environ(), supervisedEnv+"=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, output)
+
+	err := cmd.Start()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	s.setProcess(cmd.Process)
+	defer s.setProcess(nil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		terminateProcess(cmd.Process)
+		err = <-done
+	}
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return 0, output.bytes(), err
+	}
+
+	return cmd.ProcessState.ExitCode(), output.bytes(), nil
+}
+
+func (s *Supervisor) setProcess(p *os.Process) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.process = p
+}
+
+// Signal forward sig to the running agent
+func (s *Supervisor) Signal(sig os.Signal) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.process == nil {
+		return
+	}
+
+	err := s.process.Signal(sig)
+	if err != nil {
+		log.Errorf("supervisor forward signal %s failed:%v", sig, err)
+	}
+}
+
+// checkUpgrade swap the binary staged by agent, or rollback
+// if the new binary keep crashing after the deadline
+func (s *Supervisor) checkUpgrade(crashed bool) {
+	state := loadUpgradeState(s.workingDir)
+	if state == nil || state.RolledBack {
+		return
+	}
+
+	if state.Deadline == 0 {
+		if _, err := os.Stat(state.stagedExe()); err != nil {
+			return
+		}
+
+		log.Infof("supervisor swap agent binary to %s", state.Version)
+		err := swapAgentBinary(s.workingDir, state)
+		if err != nil {
+			log.Errorf("supervisor swap agent binary failed:%v", err)
+		}
+		return
+	}
+
+	if crashed && time.Now().Unix() > state.Deadline {
+		log.Errorf("agent %s keep crashing, rollback to %s", state.Version, state.OldVersion)
+		err := os.Rename(state.Backup, state.Exe)
+		if err != nil {
+			log.Errorf("supervisor rollback agent binary failed:%v", err)
+			return
+		}
+
+		state.RolledBack = true
+		saveUpgradeState(s.workingDir, state)
+	}
+}
+
+func (s *Supervisor) saveCrashLog(exitCode int, output []byte) {
+	header := fmt.Sprintf("agent exit with code %d at %s\n", exitCode, time.Now().Format(time.RFC3339))
+	buf := append([]byte(header), output...)
+
+	err := os.WriteFile(path.Join(s.workingDir, lastCrashFileName), buf, 0644)
+	if err != nil {
+		log.Errorf("supervisor save crash log failed:%v", err)
+	}
+}
+
+type CrashReport struct {
+	Time int64  `json:"time"`
+	Log  string `json:"log"`
+}
+
+// uploadCrashLog upload the crash log saved by supervisor, it is called after check in
+func (a *Agent) uploadCrashLog() {
+	p := path.Join(a.args.WorkingDir, lastCrashFileName)
+	info, err := os.Stat(p)
+	if err != nil {
+		return
+	}
+
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		log.Errorf("uploadCrashLog read file failed:%v", err)
+		return
+	}
+
+	err = a.report("crash", &CrashReport{Time: info.ModTime().Unix(), Log: string(buf)})
+	if err != nil {
+		log.Errorf("uploadCrashLog failed:%v", err)
+		return
+	}
+
+	os.Remove(p)
+}
+
+// tailBuffer keep the last size bytes written to it
+type tailBuffer struct {
+	lock sync.Mutex
+	size int
+	buf  []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.size {
+		t.buf = t.buf[len(t.buf)-t.size:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) bytes() []byte {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return append([]byte(nil), t.buf...)
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+func terminateProcess(p *os.Process) error {
+	return p.Signal(syscall.SIGTERM)
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package agent
+
+import "os"
+
+// windows has no SIGTERM
+func terminateProcess(p *os.Process) error {
+	return p.Kill()
+}
@@ -2,6 +2,7 @@ package agent
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -9,8 +10,8 @@ import (
 )
 
 type TimerEvent struct {
-	tag      string
-	callback string
+	tag   string
+	timer *Timer
 }
 
 func (te *TimerEvent) evtType() string {
@@ -19,7 +20,7 @@ func (te *TimerEvent) evtType() string {
 
 type Timer struct {
 	tag      string
-	callback string
+	callback *luaCallback
 	interval int
 
 	ctxCancelFn context.CancelFunc
@@ -55,24 +56,31 @@ func (tm *TimerModule) loader(L *lua.LState) int {
 }
 
 func (tm *TimerModule) createTimerStub(L *lua.LState) int {
-	// extract tag, interval, callback-name
+	// extract tag, interval, callback function or name
 	tag := L.ToString(1)
 	interval := L.ToInt(2)
-	callback := L.ToString(3)
+	callback, err := tm.owner.checkCallback(L, 3)
+	if err != nil {
+		L.Push(lua.LString(err.Error()))
+		return 1
+	}
 
 	log.Infof("createTimerStub tag:%s, interval:%d, callback:%s", tag, interval, callback)
 
-	if !tm.owner.hasLuaFunction(callback) {
-		return 0
+	if len(tag) < 1 {
+		L.Push(lua.LString("Must set tag"))
+		return 1
 	}
 
-	if len(tag) < 1 {
-		return 0
+	if interval <= 0 {
+		L.Push(lua.LString("Interval must be greater than 0"))
+		return 1
 	}
 
 	_, exist := tm.timerMap[tag]
 	if exist {
-		return 0
+		L.Push(lua.LString(fmt.Sprintf("Timer %s already exist", tag)))
+		return 1
 	}
 
 	ctx, ctxCancelFn := context.WithCancel(context.Background())
@@ -123,8 +131,8 @@ func (tm *TimerModule) serveTimer(timer *Timer, ctx context.Context) {
 		select {
 		case <-ticker.C:
 			ev := &TimerEvent{
-				tag:      timer.tag,
-				callback: timer.callback,
+				tag:   timer.tag,
+				timer: timer,
 			}
 
 			tm.owner.pushEvt(ev)
@@ -134,7 +142,6 @@ func (tm *TimerModule) serveTimer(timer *Timer, ctx context.Context) {
 	}
 }
 
-func (tm *TimerModule) hasTimer(tag string) bool {
-	_, ok := tm.timerMap[tag]
-	return ok
+func (tm *TimerModule) getTimer(tag string) *Timer {
+	return tm.timerMap[tag]
 }
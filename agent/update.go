@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	defaultMaxUpdateDefer = 30 * time.Minute
+
+	updateAccept = "accept"
+	updateDefer  = "defer"
+	updateReject = "reject"
+	// the deferred update is installed after max deferral
+	updateExpire = "expire"
+)
+
+// UpdateDecision is the answer of the running script to a new script, it
+// is reported to server unless the update is accepted
+type UpdateDecision struct {
+	Time int64 `json:"time"`
+	// name of plugin, empty for the main script
+	Name     string `json:"name,omitempty"`
+	MD5      string `json:"md5"`
+	Decision string `json:"decision"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// pendingUpdate is a verified script deferred by the running script
+type pendingUpdate struct {
+	md5     string
+	content []byte
+	// fire when the max deferral pass
+	timer *time.Timer
+}
+
+func (c *ScriptConfig) maxUpdateDefer() time.Duration {
+	if c != nil && c.MaxUpdateDefer > 0 {
+		return time.Duration(c.MaxUpdateDefer) * time.Second
+	}
+	return defaultMaxUpdateDefer
+}
+
+// offerUpdate ask mod.onUpdateAvailable(info) whether the script can be
+// replaced by md5 now, it return accept, defer or reject with a reason.
+// Scripts without the hook, or failed in it, accept the update
+func (s *Script) offerUpdate(md5 string, maxDefer time.Duration) (decision string, reason string) {
+	if s == nil || s.state == nil {
+		return updateAccept, ""
+	}
+
+	s.updateReady = false
+	s.updateWaiting = false
+	if !s.hasLuaFunction("onUpdateAvailable") {
+		return updateAccept, ""
+	}
+
+	info := s.state.NewTable()
+	info.RawSetString("md5", lua.LString(md5))
+	info.RawSetString("currentMD5", lua.LString(s.fileMD5))
+	info.RawSetString("maxDefer", lua.LNumber(maxDefer.Seconds()))
+
+	rets := s.callModResults("onUpdateAvailable", 2, info)
+	if rets == nil {
+		return updateAccept, ""
+	}
+
+	decision = lua.LVAsString(rets[0])
+	reason = lua.LVAsString(rets[1])
+	switch decision {
+	case updateAccept, updateDefer, updateReject:
+	case "":
+		decision = updateAccept
+	default:
+		log.Errorf("onUpdateAvailable return unknown decision %s, accept the update", decision)
+		decision = updateAccept
+	}
+
+	// wait for readyForUpdate called after now
+	s.updateWaiting = decision == updateDefer || decision == updateReject
+	return decision, reason
+}
+
+func newUpdateDecision(name, md5, decision, reason string) *UpdateDecision {
+	return &UpdateDecision{Time: time.Now().Unix(), Name: name, MD5: md5, Decision: decision, Reason: reason}
+}
+
+// offerScript install the verified script if the running script accept
+// it, or keep it until the running script is ready
+func (a *Agent) offerScript(md5 string, content []byte) {
+	a.dropPendingUpdate()
+
+	maxDefer := a.config.Script.maxUpdateDefer()
+	decision, reason := a.currentScript().offerUpdate(md5, maxDefer)
+	switch decision {
+	case updateDefer:
+		log.Infof("script update %s is deferred:%s", md5, reason)
+		a.pendingUpdate = &pendingUpdate{md5: md5, content: content, timer: time.NewTimer(maxDefer)}
+	case updateReject:
+		log.Infof("script update %s is rejected:%s", md5, reason)
+		a.rejectedUpdateMD5 = md5
+		a.rejectedUpdateTime = time.Now()
+	default:
+		a.installScript(md5, content)
+		return
+	}
+
+	a.reportUpdate(newUpdateDecision("", md5, decision, reason))
+}
+
+func (a *Agent) installScript(md5 string, content []byte) {
+	a.scriptFileContent = content
+	a.scriptFileMD5 = md5
+	a.rejectedUpdateMD5 = ""
+	err := a.updateScriptFile(content)
+	if err != nil {
+		log.Errorf("write script file failed:%v", err)
+	}
+
+	log.Info("update script file, md5 ", md5)
+}
+
+// checkPendingUpdate install the deferred script once the running script
+// call readyForUpdate or the max deferral pass
+func (a *Agent) checkPendingUpdate(expired bool) {
+	pending := a.pendingUpdate
+	if pending == nil {
+		return
+	}
+
+	script := a.currentScript()
+	if !expired && script != nil && !script.updateReady {
+		return
+	}
+
+	a.dropPendingUpdate()
+	if expired {
+		log.Infof("script update %s deferred too long, install it", pending.md5)
+		a.reportUpdate(newUpdateDecision("", pending.md5, updateExpire, ""))
+	}
+
+	a.installScript(pending.md5, pending.content)
+	a.renewScript()
+}
+
+// isRejectedUpdate return true if md5 is rejected by the running script,
+// the reject expire after the max deferral or when the script call
+// readyForUpdate, then the update is offered again
+func (a *Agent) isRejectedUpdate(md5 string) bool {
+	if a.rejectedUpdateMD5 != md5 {
+		return false
+	}
+
+	script := a.currentScript()
+	if (script != nil && script.updateReady) || time.Since(a.rejectedUpdateTime) > a.config.Script.maxUpdateDefer() {
+		a.rejectedUpdateMD5 = ""
+		return false
+	}
+
+	return true
+}
+
+// pendingDeadline fire when the deferred update should be installed
+func (a *Agent) pendingDeadline() <-chan time.Time {
+	if a.pendingUpdate == nil {
+		return nil
+	}
+	return a.pendingUpdate.timer.C
+}
+
+func (a *Agent) dropPendingUpdate() {
+	if a.pendingUpdate != nil {
+		a.pendingUpdate.timer.Stop()
+		a.pendingUpdate = nil
+	}
+}
+
+func (a *Agent) reportUpdate(decision *UpdateDecision) {
+	err := a.report("update", decision)
+	if err != nil {
+		log.Errorf("report update decision failed:%v", err)
+	}
+}
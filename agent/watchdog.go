@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCallTimeout   = 30 * time.Second
+	defaultMaxViolations = 3
+	// a script become the last known good one after running without violation
+	scriptGoodAfter      = 5 * time.Minute
+	lastGoodScriptSuffix = ".good"
+	scriptFaultFileName  = "script-fault.json"
+)
+
+// ScriptFault is reported to server when the script is unloaded,
+// the faulted script is not installed again until server change it
+type ScriptFault struct {
+	Time        int64  `json:"time"`
+	MD5         string `json:"md5"`
+	Reason      string `json:"reason"`
+	Violations  int    `json:"violations"`
+	FallbackMD5 string `json:"fallbackMD5"`
+}
+
+func (c *ScriptConfig) callTimeout() time.Duration {
+	if c != nil && c.CallTimeout > 0 {
+		return time.Duration(c.CallTimeout) * time.Second
+	}
+	return defaultCallTimeout
+}
+
+func (c *ScriptConfig) maxViolations() int {
+	if c != nil && c.MaxViolations > 0 {
+		return c.MaxViolations
+	}
+	return defaultMaxViolations
+}
+
+// faultReason return why the script should be unloaded, empty if it is fine
+func (s *Script) faultReason() string {
+	if len(s.limitErr) > 0 {
+		return "cross limit: " + s.limitErr
+	}
+
+	if s.violations >= s.config.maxViolations() {
+		return fmt.Sprintf("exceed execution budget %s", s.callTimeout)
+	}
+
+	return ""
+}
+
+// withBudget run the lua call with the execution budget, the call is
+// aborted by the context of lua state when the budget is exceeded, and the
+// memory of lua state is checked after it. Nested calls share the budget of
+// the outer one
+func (s *Script) withBudget(name string, call func()) {
+	ls := s.state
+	if ls.Context() != nil {
+		call()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.callTimeout)
+	defer cancel()
+
+	ls.SetContext(ctx)
+	call()
+	ls.RemoveContext()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		s.violations++
+		log.Errorf("lua call %s exceed execution budget %s, violations %d", name, s.callTimeout, s.violations)
+	}
+
+	// walking the state is not cheap, the calls of timers are frequent
+	if time.Since(s.lastMemoryCheck) >= memoryCheckInterval {
+		s.checkMemory()
+	}
+}
+
+func (a *Agent) lastGoodScriptPath() string {
+	return path.Join(a.args.WorkingDir, a.args.ScriptFileName+lastGoodScriptSuffix)
+}
+
+// markScriptGood keep a copy of the script once it run long enough
+// without violation, it is the fallback of the later scripts
+func (a *Agent) markScriptGood() {
+	script := a.currentScript()
+	if script == nil || len(script.fileMD5) == 0 || script.fileMD5 == a.goodScriptMD5 {
+		return
+	}
+
+	if script.violations > 0 || time.Since(script.startTime) < scriptGoodAfter {
+		return
+	}
+
+	err := os.WriteFile(a.lastGoodScriptPath(), a.scriptFileContent, 0644)
+	if err != nil {
+		log.Errorf("save last good script failed:%v", err)
+		return
+	}
+
+	a.goodScriptMD5 = script.fileMD5
+	log.Infof("script %s is marked as last known good", script.fileMD5)
+}
+
+// checkWatchdog unload the script after repeated budget violations or
+// crossing its limits, it is replaced by the last known good script, or no script if there is none
+func (a *Agent) checkWatchdog() {
+	script := a.currentScript()
+	if script == nil {
+		return
+	}
+
+	reason := script.faultReason()
+	if len(reason) == 0 {
+		return
+	}
+
+	fault := &ScriptFault{
+		Time:       time.Now().Unix(),
+		MD5:        script.fileMD5,
+		Reason:     reason,
+		Violations: script.violations,
+	}
+	a.fallbackScript(fault)
+}
+
+// fallbackScript replace the faulted script with the last known good one
+func (a *Agent) fallbackScript(fault *ScriptFault) {
+	var content []byte
+	buf, err := os.ReadFile(a.lastGoodScriptPath())
+	if err == nil && fmt.Sprintf("%x", md5.Sum(buf)) != fault.MD5 {
+		content = buf
+		fault.FallbackMD5 = fmt.Sprintf("%x", md5.Sum(buf))
+	} else if err == nil {
+		// the good script fault too
+		os.Remove(a.lastGoodScriptPath())
+		a.goodScriptMD5 = ""
+	}
+
+	log.Errorf("script %s %s, fall back to script %s", fault.MD5, fault.Reason, fault.FallbackMD5)
+	a.setUpdateErr(fmt.Errorf("script %s %s", fault.MD5, fault.Reason))
+
+	a.scriptFault = fault
+	a.saveScriptFault()
+
+	a.scriptFileContent = content
+	a.scriptFileMD5 = fault.FallbackMD5
+	scriptPath := path.Join(a.args.WorkingDir, a.args.ScriptFileName)
+	if content != nil {
+		err = a.updateScriptFile(content)
+	} else if err = os.Remove(scriptPath); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		log.Errorf("replace faulted script failed:%v", err)
+	}
+
+	// the state of faulted script is not handed over
+	if a.script != nil {
+		a.script.stop()
+		a.script = nil
+	}
+	a.renewScript()
+
+	err = a.report("script", fault)
+	if err != nil {
+		log.Errorf("report script fault failed:%v", err)
+	}
+}
+
+// isFaultedScript return true if the md5 is the script unloaded by watchdog
+func (a *Agent) isFaultedScript(md5 string) bool {
+	return a.scriptFault != nil && a.scriptFault.MD5 == md5
+}
+
+// loadWatchdogState restore the faulted script and the last good script
+func (a *Agent) loadWatchdogState() {
+	if buf, err := os.ReadFile(a.lastGoodScriptPath()); err == nil {
+		a.goodScriptMD5 = fmt.Sprintf("%x", md5.Sum(buf))
+	}
+
+	buf, err := os.ReadFile(path.Join(a.args.WorkingDir, scriptFaultFileName))
+	if err != nil {
+		return
+	}
+
+	fault := &ScriptFault{}
+	if err := json.Unmarshal(buf, fault); err != nil {
+		log.Errorf("load script fault failed:%v", err)
+		return
+	}
+	a.scriptFault = fault
+}
+
+func (a *Agent) saveScriptFault() {
+	buf, err := json.Marshal(a.scriptFault)
+	if err != nil {
+		return
+	}
+
+	err = os.WriteFile(path.Join(a.args.WorkingDir, scriptFaultFileName), buf, 0644)
+	if err != nil {
+		log.Errorf("save script fault failed:%v", err)
+	}
+}
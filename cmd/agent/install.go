@@ -0,0 +1,469 @@
+package main
+
+import (
+	"agent/agent"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	systemdDir  = "/etc/systemd/system"
+	sysVInitDir = "/etc/init.d"
+	// environment of the service in working dir, it hold the secrets so
+	// only root can read it
+	serviceEnvFileName = "service.env"
+	// the working dir to purge must be at least /a/b
+	minPurgeDirDepth = 2
+)
+
+// environment variables carried into the service besides the flags
+var serviceEnvNames = []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy"}
+
+// flags passed by environment in the env file instead of command line, the
+// command line is visible to all users
+var secretFlagNames = []string{"enroll-token"}
+
+var systemdUnitTemplate = template.Must(template.New("unit").Funcs(template.FuncMap{"path": systemdPath}).Parse(`[Unit]
+Description=Titan agent
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart={{.ExecStart}}
+WorkingDirectory={{path .WorkingDir}}
+EnvironmentFile=-{{path .EnvFile}}
+Restart=always
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+var sysVInitTemplate = template.Must(template.New("init").Funcs(template.FuncMap{"sh": shQuote}).Parse(`#!/bin/sh
+### BEGIN INIT INFO
+# Provides:          {{.Name}}
+# Required-Start:    $network $remote_fs
+# Required-Stop:     $network $remote_fs
+# Default-Start:     2 3 4 5
+# Default-Stop:      0 1 6
+# Short-Description: Titan agent
+### END INIT INFO
+
+PIDFILE=/var/run/{{.Name}}.pid
+LOGFILE={{sh .WorkingDir}}/agent.log
+if [ -f {{sh .EnvFile}} ]; then
+    set -a
+    . {{sh .EnvFile}}
+    set +a
+fi
+
+is_running() {
+    [ -f "$PIDFILE" ] && kill -0 "$(cat "$PIDFILE")" 2>/dev/null
+}
+
+case "$1" in
+    start)
+        if is_running; then
+            echo "{{.Name}} already running"
+            exit 0
+        fi
+        cd {{sh .WorkingDir}}
+        nohup {{.ExecStart}} >>"$LOGFILE" 2>&1 &
+        echo $! >"$PIDFILE"
+        ;;
+    stop)
+        if is_running; then
+            kill "$(cat "$PIDFILE")"
+            while is_running; do sleep 1; done
+        fi
+        rm -f "$PIDFILE"
+        ;;
+    restart)
+        $0 stop
+        $0 start
+        ;;
+    status)
+        if is_running; then
+            echo "{{.Name}} is running"
+        else
+            echo "{{.Name}} is stopped"
+            exit 3
+        fi
+        ;;
+    *)
+        echo "Usage: $0 {start|stop|restart|status}"
+        exit 1
+        ;;
+esac
+`))
+
+type serviceConfig struct {
+	Name string
+	Args []string
+	// "NAME=value" written to the env file
+	Env []string
+
+	// quoted for the service manager by install
+	ExecStart  string
+	WorkingDir string
+	EnvFile    string
+}
+
+var serviceNameFlag = &cli.StringFlag{
+	Name:  "service-name",
+	Usage: "--service-name titan-agent",
+	Value: "titan-agent",
+}
+
+var installCmd = &cli.Command{
+	Name:  "install",
+	Usage: "register agent as a system service and start it, agent flags must before the command",
+	Flags: []cli.Flag{
+		serviceNameFlag,
+		&cli.BoolFlag{
+			Name:  "no-start",
+			Usage: "--no-start do not start the service after install",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("install not support on %s", runtime.GOOS)
+		}
+
+		config, err := newServiceConfig(cctx)
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(config.WorkingDir, 0750)
+		if err != nil {
+			return err
+		}
+
+		// MkdirAll does not change the mode of an existing dir
+		err = os.Chmod(config.WorkingDir, 0750)
+		if err != nil {
+			return err
+		}
+
+		err = writeEnvFile(config)
+		if err != nil {
+			return err
+		}
+
+		if hasSystemd() {
+			return installSystemd(config, !cctx.Bool("no-start"))
+		}
+		return installSysV(config, !cctx.Bool("no-start"))
+	},
+}
+
+var uninstallCmd = &cli.Command{
+	Name:  "uninstall",
+	Usage: "stop agent and the business processes, and remove the system service",
+	Flags: []cli.Flag{
+		serviceNameFlag,
+		&cli.BoolFlag{
+			Name:  "purge",
+			Usage: "--purge remove the working dir",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("uninstall not support on %s", runtime.GOOS)
+		}
+
+		// check before the service is removed, so nothing is done on a bad dir
+		var workingDir string
+		if cctx.Bool("purge") {
+			var err error
+			workingDir, err = purgeDir(cctx.String("working-dir"))
+			if err != nil {
+				return err
+			}
+		}
+
+		name := cctx.String("service-name")
+		// stopping the service stop the script, which kill all the business processes
+		var err error
+		if hasSystemd() {
+			err = uninstallSystemd(name)
+		} else {
+			err = uninstallSysV(name)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if len(workingDir) > 0 {
+			log.Printf("Remove working dir %s", workingDir)
+			return os.RemoveAll(workingDir)
+		}
+
+		return nil
+	},
+}
+
+// purgeDir check the working dir is safe to remove, it must be an absolute
+// path at least two levels deep other than home or its parents, and hold
+// the files created by agent
+func purgeDir(workingDir string) (string, error) {
+	if !filepath.IsAbs(workingDir) {
+		return "", fmt.Errorf("refuse to purge relative working dir %s", workingDir)
+	}
+
+	dir, err := filepath.EvalSymlinks(workingDir)
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Clean(dir)
+
+	protected := []string{"/"}
+	if home, err := os.UserHomeDir(); err == nil {
+		protected = append(protected, home)
+	}
+	for _, p := range protected {
+		if p, err := filepath.EvalSymlinks(p); err == nil && isParentDir(dir, p) {
+			return "", fmt.Errorf("refuse to purge working dir %s", workingDir)
+		}
+	}
+
+	if len(strings.Split(strings.Trim(filepath.ToSlash(dir), "/"), "/")) < minPurgeDirDepth {
+		return "", fmt.Errorf("refuse to purge working dir %s, it is too close to root", workingDir)
+	}
+
+	if !agent.IsWorkingDir(dir) {
+		return "", fmt.Errorf("refuse to purge working dir %s, it is not created by agent", workingDir)
+	}
+
+	return dir, nil
+}
+
+// isParentDir return true if dir is p or one of its parents
+func isParentDir(dir string, p string) bool {
+	rel, err := filepath.Rel(dir, filepath.Clean(p))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+func newServiceConfig(cctx *cli.Context) (*serviceConfig, error) {
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	workingDir, err := filepath.Abs(cctx.String("working-dir"))
+	if err != nil {
+		return nil, err
+	}
+
+	config := &serviceConfig{
+		Name:       cctx.String("service-name"),
+		Args:       []string{exe},
+		WorkingDir: workingDir,
+		EnvFile:    filepath.Join(workingDir, serviceEnvFileName),
+	}
+
+	for _, flag := range flags {
+		name := flag.Names()[0]
+		value := cctx.String(name)
+		if name == "working-dir" {
+			value = workingDir
+		} else if !cctx.IsSet(name) {
+			// keep the default values overridable by the config file
+			continue
+		}
+
+		if isSecretFlag(name) {
+			envVars := flag.(*cli.StringFlag).EnvVars
+			config.Env = append(config.Env, fmt.Sprintf("%s=%s", envVars[0], value))
+			continue
+		}
+		config.Args = append(config.Args, fmt.Sprintf("--%s=%s", name, value))
+	}
+	config.Args = append(config.Args, superviseCmd.Name)
+
+	for _, name := range serviceEnvNames {
+		if value, ok := os.LookupEnv(name); ok {
+			config.Env = append(config.Env, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+
+	return config, nil
+}
+
+func isSecretFlag(name string) bool {
+	for _, secret := range secretFlagNames {
+		if name == secret {
+			return true
+		}
+	}
+	return false
+}
+
+// writeEnvFile write the env of service readable by root only, the file is
+// read by both systemd and sh, so values are single quoted without escape
+func writeEnvFile(config *serviceConfig) error {
+	buf := bytes.Buffer{}
+	for _, env := range config.Env {
+		name, value, _ := strings.Cut(env, "=")
+		if strings.ContainsAny(value, "'\\\n") {
+			return fmt.Errorf("environment %s contain quote, backslash or newline", name)
+		}
+		fmt.Fprintf(&buf, "%s='%s'\n", name, value)
+	}
+
+	// WriteFile does not change the mode of an existing file
+	os.Remove(config.EnvFile)
+	return os.WriteFile(config.EnvFile, buf.Bytes(), 0600)
+}
+
+// systemdQuote quote the arg for ExecStart, $ and % are expanded by systemd
+func systemdQuote(arg string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "$", "$$", "%", "%%")
+	return `"` + replacer.Replace(arg) + `"`
+}
+
+// systemdPath escape the specifiers in path settings, they are not quoted
+func systemdPath(p string) string {
+	return strings.ReplaceAll(p, "%", "%%")
+}
+
+// shQuote quote the arg for sh, nothing is expanded in single quotes
+func shQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+func joinArgs(args []string, quote func(string) string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, quote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+func hasSystemd() bool {
+	_, err := os.Stat("/run/systemd/system")
+	return err == nil
+}
+
+func installSystemd(config *serviceConfig, start bool) error {
+	unitFile := filepath.Join(systemdDir, config.Name+".service")
+	config.ExecStart = joinArgs(config.Args, systemdQuote)
+	err := writeTemplate(unitFile, systemdUnitTemplate, config, 0644)
+	if err != nil {
+		return err
+	}
+
+	commands := [][]string{
+		{"systemctl", "daemon-reload"},
+		{"systemctl", "enable", config.Name},
+	}
+	if start {
+		commands = append(commands, []string{"systemctl", "restart", config.Name})
+	}
+
+	log.Printf("Install systemd service %s", unitFile)
+	return runCommands(commands)
+}
+
+func uninstallSystemd(name string) error {
+	unitFile := filepath.Join(systemdDir, name+".service")
+	if _, err := os.Stat(unitFile); err != nil {
+		return fmt.Errorf("service %s not installed", name)
+	}
+
+	// ignore errors, the service may not running
+	runCommands([][]string{
+		{"systemctl", "stop", name},
+		{"systemctl", "disable", name},
+	})
+
+	err := os.Remove(unitFile)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Remove systemd service %s", unitFile)
+	return runCommands([][]string{{"systemctl", "daemon-reload"}})
+}
+
+func installSysV(config *serviceConfig, start bool) error {
+	initFile := filepath.Join(sysVInitDir, config.Name)
+	config.ExecStart = joinArgs(config.Args, shQuote)
+	err := writeTemplate(initFile, sysVInitTemplate, config, 0755)
+	if err != nil {
+		return err
+	}
+
+	var commands [][]string
+	if _, err := exec.LookPath("update-rc.d"); err == nil {
+		commands = append(commands, []string{"update-rc.d", config.Name, "defaults"})
+	} else if _, err := exec.LookPath("chkconfig"); err == nil {
+		commands = append(commands, []string{"chkconfig", "--add", config.Name})
+	}
+
+	if start {
+		commands = append(commands, []string{initFile, "restart"})
+	}
+
+	log.Printf("Install SysV init script %s", initFile)
+	return runCommands(commands)
+}
+
+func uninstallSysV(name string) error {
+	initFile := filepath.Join(sysVInitDir, name)
+	if _, err := os.Stat(initFile); err != nil {
+		return fmt.Errorf("service %s not installed", name)
+	}
+
+	commands := [][]string{{initFile, "stop"}}
+	if _, err := exec.LookPath("update-rc.d"); err == nil {
+		commands = append(commands, []string{"update-rc.d", "-f", name, "remove"})
+	} else if _, err := exec.LookPath("chkconfig"); err == nil {
+		commands = append(commands, []string{"chkconfig", "--del", name})
+	}
+
+	err := runCommands(commands)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Remove SysV init script %s", initFile)
+	return os.Remove(initFile)
+}
+
+func writeTemplate(filePath string, t *template.Template, config *serviceConfig, mode os.FileMode) error {
+	buf := bytes.Buffer{}
+	err := t.Execute(&buf, config)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filePath, buf.Bytes(), mode)
+}
+
+func runCommands(commands [][]string) error {
+	for _, command := range commands {
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s failed:%v", strings.Join(command, " "), err)
+		}
+	}
+	return nil
+}
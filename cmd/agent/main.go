@@ -3,6 +3,7 @@ package main
 import (
 	"agent/agent"
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -11,38 +12,81 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
+var flags = []cli.Flag{
+	&cli.StringFlag{
+		Name:     "working-dir",
+		Usage:    "--working-dir=/path/to/working/dir",
+		EnvVars:  []string{"WORKING_DIR"},
+		Required: true,
+		Value:    "",
+	},
+	&cli.StringFlag{
+		Name:    "script-file-name",
+		Usage:   "--script-file-name script.lua",
+		EnvVars: []string{"SCRIPT_FILE_NAME"},
+		Value:   "script.lua",
+	},
+
+	&cli.IntFlag{
+		Name:    "script-interval",
+		Usage:   "--script-interval 60",
+		EnvVars: []string{"SCRIPT_INTERVAL"},
+		Value:   60,
+	},
+	&cli.StringFlag{
+		Name:    "server-url",
+		Usage:   "--server-url http://localhost:8080/update/lua",
+		EnvVars: []string{"SERVER_URL"},
+		Value:   "http://localhost:8080/update/lua",
+	},
+	&cli.StringFlag{
+		Name:    "server-srv",
+		Usage:   "--server-srv _titan._tcp.example.com, dns srv record of the fallback servers",
+		EnvVars: []string{"SERVER_SRV"},
+	},
+	&cli.StringFlag{
+		Name:    "enroll-token",
+		Usage:   "--enroll-token xxx, token to enroll the device, only required before enrolled",
+		EnvVars: []string{"ENROLL_TOKEN"},
+	},
+	&cli.StringFlag{
+		Name:    "config",
+		Usage:   "--config agent.json, relative to working dir, flags and env override the config file",
+		EnvVars: []string{"AGENT_CONFIG"},
+		Value:   "agent.json",
+	},
+}
+
+var superviseCmd = &cli.Command{
+	Name:  "supervise",
+	Usage: "run agent as a child process and restart it when it exit, agent flags must before the command",
+	Action: func(cctx *cli.Context) error {
+		// the child run the root command with the same arguments, only the
+		// command itself is removed, it is followed by its own arguments
+		pos := len(os.Args) - cctx.Args().Len() - 1
+		if pos < 1 || os.Args[pos] != cctx.Command.Name {
+			return fmt.Errorf("agent flags must before the %s command", cctx.Command.Name)
+		}
+
+		args := make([]string, 0, len(os.Args))
+		args = append(args, os.Args[1:pos]...)
+		args = append(args, os.Args[pos+1:]...)
+
+		supervisor := agent.NewSupervisor(cctx.String("working-dir"), args)
+		forwardSignals(supervisor)
+		return supervisor.Run(signalContext(cctx.Context))
+	},
+}
+
 func main() {
 	app := &cli.App{
 		Name:  "agent",
 		Usage: "Manager and update business process",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:     "working-dir",
-				Usage:    "--working-dir=/path/to/working/dir",
-				EnvVars:  []string{"WORKING_DIR"},
-				Required: true,
-				Value:    "",
-			},
-			&cli.StringFlag{
-				Name:    "script-file-name",
-				Usage:   "--script-file-name script.lua",
-				EnvVars: []string{"SCRIPT_FILE_NAME"},
-				Value:   "script.lua",
-			},
-
-			&cli.IntFlag{
-				Name:    "script-interval",
-				Usage:   "--script-interval 60",
-				EnvVars: []string{"SCRIPT_INTERVAL"},
-				Value:   60,
-			},
-			&cli.StringFlag{
-				Name:     "server-url",
-				Usage:    "--server-url http://localhost:8080/update/lua",
-				EnvVars:  []string{"SERVER_URL"},
-				Required: true,
-				Value:    "http://localhost:8080/update/lua",
-			},
+		Flags: flags,
+		Commands: []*cli.Command{
+			superviseCmd,
+			installCmd,
+			uninstallCmd,
 		},
 		Before: func(cctx *cli.Context) error {
 			return nil
@@ -54,22 +98,29 @@ func main() {
 
 				ScriptInvterval: cctx.Int("script-interval"),
 				ServerURL:       cctx.String("server-url"),
+
+				ConfigFileName: cctx.String("config"),
 			}
 
+			if cctx.IsSet("script-file-name") {
+				agrs.Overrides.ScriptFileName = agrs.ScriptFileName
+			}
+			if cctx.IsSet("script-interval") {
+				agrs.Overrides.ScriptInterval = agrs.ScriptInvterval
+			}
+			if cctx.IsSet("server-url") {
+				agrs.Overrides.ServerURL = agrs.ServerURL
+			}
+			agrs.Overrides.ServerSRV = cctx.String("server-srv")
+			agrs.Overrides.EnrollToken = cctx.String("enroll-token")
+
 			agent, err := agent.New(agrs)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			ctx, done := context.WithCancel(cctx.Context)
-			sigChan := make(chan os.Signal, 2)
-			go func() {
-				<-sigChan
-				done()
-			}()
-
-			signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
-			return agent.Run(ctx)
+			handleSignals(agent)
+			return agent.Run(signalContext(cctx.Context))
 		},
 	}
 
@@ -77,3 +128,15 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+func signalContext(parent context.Context) context.Context {
+	ctx, done := context.WithCancel(parent)
+	sigChan := make(chan os.Signal, 2)
+	go func() {
+		<-sigChan
+		done()
+	}()
+
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	return ctx
+}
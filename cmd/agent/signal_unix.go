@@ -0,0 +1,39 @@
+//go:build !windows
+
+package main
+
+import (
+	"agent/agent"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals reload the agent on SIGHUP and dump its state on SIGUSR1
+func handleSignals(a *agent.Agent) {
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGUSR1)
+
+	go func() {
+		for sig := range sigChan {
+			switch sig {
+			case syscall.SIGHUP:
+				a.Reload()
+			case syscall.SIGUSR1:
+				a.DumpState()
+			}
+		}
+	}()
+}
+
+// forwardSignals pass SIGHUP and SIGUSR1 to the supervised agent
+func forwardSignals(s *agent.Supervisor) {
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGUSR1)
+
+	go func() {
+		for sig := range sigChan {
+			s.Signal(sig)
+		}
+	}()
+}
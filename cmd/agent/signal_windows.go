@@ -0,0 +1,12 @@
+//go:build windows
+
+package main
+
+import "agent/agent"
+
+// windows has no SIGHUP and SIGUSR1
+func handleSignals(a *agent.Agent) {
+}
+
+func forwardSignals(s *agent.Supervisor) {
+}
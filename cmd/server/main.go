@@ -36,14 +36,19 @@ var runCmd = &cli.Command{
 		},
 		&cli.StringFlag{
 			Name:  "file-server",
-			Usage: "--file-server ./my-file-server",
-			Value: "./",
+			Usage: "--file-server ./files, the config file and data dir in it are not served",
+			Value: "./files",
 		},
 		&cli.StringFlag{
 			Name:  "config",
 			Usage: "--config ./config.json",
 			Value: "./config.json",
 		},
+		&cli.StringFlag{
+			Name:  "data-dir",
+			Usage: "--data-dir ./data, keep enrollments and other server state",
+			Value: "./data",
+		},
 	},
 
 	Before: func(cctx *cli.Context) error {
@@ -53,16 +58,24 @@ var runCmd = &cli.Command{
 		listenAddress := cctx.String("listen")
 		configFilePath := cctx.String("config")
 		fileServerDir := cctx.String("file-server")
+		dataDir := cctx.String("data-dir")
 
 		config, err := server.ParseConfig(configFilePath)
 		if err != nil {
 			return err
 		}
 
-		_ = config
-		mux := server.NewCustomServerMux(config)
+		err = os.MkdirAll(dataDir, 0700)
+		if err != nil {
+			return err
+		}
+
+		mux, err := server.NewCustomServerMux(config, dataDir)
+		if err != nil {
+			return err
+		}
 
-		http.Handle("/", http.FileServer(http.Dir(fileServerDir)))
+		http.Handle("/", mux.FileServer(fileServerDir, configFilePath, dataDir))
 
 		// Start the server
 		fmt.Println("Starting server on ", listenAddress)
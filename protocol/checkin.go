@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"fmt"
+)
+
+// CheckinSchemaVersion is the version of CheckinRequest, bump it on
+// incompatible change. Optional fields can be added without bumping it,
+// server ignore the fields it does not know
+const CheckinSchemaVersion = 1
+
+// CheckinRequest is the body agent post to the update url
+type CheckinRequest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	AgentVersion  string `json:"agentVersion"`
+	GOOS          string `json:"goos"`
+	GOARCH        string `json:"goarch"`
+	// token of enrollment, it is only required before device is enrolled
+	EnrollToken string `json:"enrollToken,omitempty"`
+	// base64 ed25519 public key of device, it is registered on enrollment
+	PublicKey string `json:"publicKey,omitempty"`
+
+	Device *DeviceInfo `json:"device"`
+}
+
+type DeviceInfo struct {
+	HostName        string `json:"hostname"`
+	OS              string `json:"os"`
+	Platform        string `json:"platform"`
+	PlatformVersion string `json:"platformVersion"`
+	BootTime        int64  `json:"bootTime"`
+	Arch            string `json:"arch"`
+
+	Macs string `json:"macs"`
+
+	CPUModuleName   string  `json:"cpuModuleName"`
+	CPUCores        int     `json:"cpuCores"`
+	CPUMhz          float64 `json:"cpuMhz"`
+	TotalMemory     int64   `json:"totalMemory"`
+	UsedMemory      int64   `json:"usedMemory"`
+	AvailableMemory int64   `json:"availableMemory"`
+	Baseboard       string  `json:"baseboard"`
+
+	UUID                string `json:"uuid"`
+	AndroidID           string `json:"androidID"`
+	AndroidSerialNumber string `json:"androidSerialNumber"`
+}
+
+// ErrorResponse is returned with a non 2xx status code
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func (r *CheckinRequest) Validate() error {
+	if r.SchemaVersion != CheckinSchemaVersion {
+		return fmt.Errorf("unsupported schema version %d, expect %d", r.SchemaVersion, CheckinSchemaVersion)
+	}
+
+	if len(r.AgentVersion) == 0 {
+		return fmt.Errorf("agentVersion is required")
+	}
+
+	if r.Device == nil {
+		return fmt.Errorf("device is required")
+	}
+
+	return r.Device.Validate()
+}
+
+func (d *DeviceInfo) Validate() error {
+	if len(d.UUID) == 0 {
+		return fmt.Errorf("device.uuid is required")
+	}
+
+	if len(d.OS) == 0 {
+		return fmt.Errorf("device.os is required")
+	}
+
+	if d.BootTime < 0 || d.CPUCores < 0 || d.CPUMhz < 0 {
+		return fmt.Errorf("device.bootTime, device.cpuCores and device.cpuMhz can not be negative")
+	}
+
+	if d.TotalMemory < 0 || d.UsedMemory < 0 || d.AvailableMemory < 0 {
+		return fmt.Errorf("device memory can not be negative")
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+package protocol
+
+type EnrollStatus string
+
+const (
+	EnrollPending  EnrollStatus = "pending"
+	EnrollApproved EnrollStatus = "approved"
+	EnrollRejected EnrollStatus = "rejected"
+)
+
+// Enrollment is returned in every check in response, only approved
+// devices receive scripts, packages and commands
+type Enrollment struct {
+	Status EnrollStatus `json:"status"`
+	Reason string       `json:"reason,omitempty"`
+}
@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// headers of the requests signed by device key
+const (
+	HeaderDeviceID  = "X-Device-ID"
+	HeaderTimestamp = "X-Timestamp"
+	HeaderNonce     = "X-Nonce"
+	HeaderSignature = "X-Signature"
+)
+
+// SignatureMaxSkew is how far the request timestamp can be from server time,
+// nonces are kept at least this long to reject replay
+const SignatureMaxSkew = 5 * time.Minute
+
+// BodyHash is the hex sha256 of the raw request body
+func BodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// SigningString is the content signed by device key, host is the host
+// and port the request is sent to, uri is the path and query of the request
+func SigningString(method, host, uri, deviceID, timestamp, nonce, bodyHash string) string {
+	return fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%s\n%s", method, strings.ToLower(host), uri, deviceID, timestamp, nonce, bodyHash)
+}
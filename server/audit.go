@@ -0,0 +1,423 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	auditFileName = "audit.jsonl"
+	// max entries returned by a query without limit
+	defaultAuditLimit = 1000
+	maxAuditLineSize  = 1 << 20
+)
+
+// AuditEntry is a line of the audit log, Hash chain the entry to the previous
+// one so any modified or removed entry can be detected
+type AuditEntry struct {
+	Seq     int64           `json:"seq"`
+	Time    int64           `json:"time"`
+	Actor   string          `json:"actor"`
+	Role    Role            `json:"role"`
+	IP      string          `json:"ip"`
+	Action  string          `json:"action"`
+	Targets []string        `json:"targets"`
+	Before  json.RawMessage `json:"before,omitempty"`
+	After   json.RawMessage `json:"after,omitempty"`
+
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+func (e *AuditEntry) computeHash() (string, error) {
+	copied := *e
+	copied.Hash = ""
+	buf, err := json.Marshal(&copied)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog append entries to a json lines file in data dir
+type AuditLog struct {
+	lock     sync.Mutex
+	filePath string
+	file     *os.File
+	lastSeq  int64
+	lastHash string
+}
+
+func newAuditLog(dataDir string) (*AuditLog, error) {
+	al := &AuditLog{filePath: path.Join(dataDir, auditFileName)}
+
+	err := al.endTornLine()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := al.verify()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Error) > 0 {
+		log.Errorf("audit log %s is broken at seq %d: %s", al.filePath, result.BrokenSeq, result.Error)
+	}
+	al.lastSeq = result.LastSeq
+	al.lastHash = result.LastHash
+
+	al.file, err = os.OpenFile(al.filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return al, nil
+}
+
+// endTornLine terminate the last line left by an interrupted write, so
+// the entries are appended after it, verify report it as a broken entry
+func (al *AuditLog) endTornLine() error {
+	f, err := os.OpenFile(al.filePath, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+
+	last := make([]byte, 1)
+	_, err = f.ReadAt(last, info.Size()-1)
+	if err != nil || last[0] == '\n' {
+		return err
+	}
+
+	log.Errorf("audit log %s end with a torn line, it is skipped", al.filePath)
+	_, err = f.Write([]byte("\n"))
+	return err
+}
+
+func (al *AuditLog) append(e *AuditEntry) error {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	e.Seq = al.lastSeq + 1
+	e.PrevHash = al.lastHash
+
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = al.file.Write(append(buf, '\n'))
+	if err != nil {
+		return err
+	}
+
+	err = al.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	al.lastSeq = e.Seq
+	al.lastHash = e.Hash
+	return nil
+}
+
+// each call the fn with entries in order until it return false, only the
+// entries written before the call are read, so append is not blocked by
+// a slow reader and no partial line is read. The line which is not a valid
+// entry is passed with nil e
+func (al *AuditLog) each(fn func(e *AuditEntry, line []byte) bool) error {
+	f, size, err := al.openSnapshot()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(f, size))
+	scanner.Buffer(make([]byte, 64*1024), maxAuditLineSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		e := &AuditEntry{}
+		if err := json.Unmarshal(line, e); err != nil {
+			e = nil
+		}
+
+		if !fn(e, line) {
+			break
+		}
+	}
+
+	return scanner.Err()
+}
+
+// openSnapshot open the log and return the size of the complete entries,
+// append write whole lines under the lock
+func (al *AuditLog) openSnapshot() (*os.File, int64, error) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	f, err := os.Open(al.filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, info.Size(), nil
+}
+
+type AuditVerifyResult struct {
+	Entries   int64  `json:"entries"`
+	LastSeq   int64  `json:"lastSeq"`
+	LastHash  string `json:"lastHash"`
+	BrokenSeq int64  `json:"brokenSeq,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// verify walk the hash chain, it report the first broken entry and
+// the last entry to append after
+func (al *AuditLog) verify() (*AuditVerifyResult, error) {
+	result := &AuditVerifyResult{}
+	err := al.each(func(e *AuditEntry, line []byte) bool {
+		if e == nil {
+			if len(result.Error) == 0 {
+				result.Error = fmt.Sprintf("invalid entry after seq %d", result.LastSeq)
+				result.BrokenSeq = result.LastSeq + 1
+			}
+			return true
+		}
+		result.Entries++
+
+		if len(result.Error) == 0 {
+			hash, err := e.computeHash()
+			switch {
+			case err != nil:
+				result.Error = err.Error()
+			case e.Seq != result.LastSeq+1:
+				result.Error = fmt.Sprintf("expect seq %d", result.LastSeq+1)
+			case e.PrevHash != result.LastHash:
+				result.Error = "prev hash not match"
+			case e.Hash != hash:
+				result.Error = "hash not match"
+			}
+
+			if len(result.Error) > 0 {
+				result.BrokenSeq = e.Seq
+			}
+		}
+
+		result.LastSeq = e.Seq
+		result.LastHash = e.Hash
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+type auditFilter struct {
+	actor  string
+	action string
+	target string
+	since  int64
+	until  int64
+	limit  int
+}
+
+func (f *auditFilter) match(e *AuditEntry) bool {
+	if len(f.actor) > 0 && e.Actor != f.actor {
+		return false
+	}
+
+	if len(f.action) > 0 && e.Action != f.action {
+		return false
+	}
+
+	if f.since > 0 && e.Time < f.since {
+		return false
+	}
+
+	if f.until > 0 && e.Time > f.until {
+		return false
+	}
+
+	if len(f.target) > 0 {
+		for _, t := range e.Targets {
+			if t == f.target {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func parseAuditFilter(r *http.Request) (*auditFilter, error) {
+	query := r.URL.Query()
+	f := &auditFilter{
+		actor:  query.Get("actor"),
+		action: query.Get("action"),
+		target: query.Get("target"),
+		limit:  defaultAuditLimit,
+	}
+
+	var err error
+	for key, v := range map[string]*int64{"since": &f.since, "until": &f.until} {
+		if s := query.Get(key); len(s) > 0 {
+			*v, err = strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", key, s)
+			}
+		}
+	}
+
+	if s := query.Get("limit"); len(s) > 0 {
+		f.limit, err = strconv.Atoi(s)
+		if err != nil || f.limit < 0 {
+			return nil, fmt.Errorf("invalid limit: %s", s)
+		}
+	}
+
+	return f, nil
+}
+
+// audit record an admin action of the caller, before and after are the
+// values of the target, either can be nil
+func (h *CustomHandler) audit(r *http.Request, action string, targets []string, before, after interface{}) {
+	e := &AuditEntry{
+		Time:    time.Now().Unix(),
+		Action:  action,
+		Targets: targets,
+		IP:      r.RemoteAddr,
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.IP = host
+	}
+
+	if p := principalFromContext(r.Context()); p != nil {
+		e.Actor = p.Name
+		e.Role = p.Role
+	}
+
+	var err error
+	if before != nil {
+		e.Before, err = json.Marshal(before)
+	}
+	if err == nil && after != nil {
+		e.After, err = json.Marshal(after)
+	}
+	if err == nil {
+		err = h.auditLog.append(e)
+	}
+
+	if err != nil {
+		log.Errorf("audit %s by %s failed:%v", action, e.Actor, err)
+	}
+}
+
+// auditDenied record a request rejected by authentication or authorization,
+// the actor is empty if the caller is not authenticated
+func (h *CustomHandler) auditDenied(r *http.Request, reason string) {
+	h.audit(r, "auth.denied", []string{r.Method + " " + r.URL.Path}, nil, map[string]string{"reason": reason})
+}
+
+// handleAuditQuery return the matched entries, format=jsonl export them as json lines
+func (h *CustomHandler) handleAuditQuery(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		resultError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	jsonLines := r.URL.Query().Get("format") == "jsonl"
+	if jsonLines {
+		// export all the matched entries by default
+		if len(r.URL.Query().Get("limit")) == 0 {
+			filter.limit = 0
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", auditFileName))
+	}
+
+	entries := make([]*AuditEntry, 0)
+	count := 0
+	err = h.auditLog.each(func(e *AuditEntry, line []byte) bool {
+		if e == nil || !filter.match(e) {
+			return true
+		}
+
+		count++
+		if jsonLines {
+			w.Write(line)
+			w.Write([]byte("\n"))
+		} else {
+			entries = append(entries, e)
+		}
+		return filter.limit == 0 || count < filter.limit
+	})
+
+	if jsonLines {
+		if err != nil {
+			log.Errorf("export audit log failed:%v", err)
+		}
+		return
+	}
+
+	if err != nil {
+		resultError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resultJSON(w, entries)
+}
+
+func (h *CustomHandler) handleAuditVerify(w http.ResponseWriter, r *http.Request) {
+	result, err := h.auditLog.verify()
+	if err != nil {
+		resultError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resultJSON(w, result)
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type Role string
+
+// viewer can read the state, operator can change devices and publish to
+// canaries, admin can publish to the whole fleet and manage keys
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+var roleLevels = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// allows return true if r has all the permissions of required
+func (r Role) allows(required Role) bool {
+	return roleLevels[r] >= roleLevels[required]
+}
+
+// Principal is the authenticated caller of admin api
+type Principal struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+// Authenticator identify the caller, it return nil principal and nil
+// error if the request does not carry its credential
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// APIToken is set in config file, TokenSHA256 can be used instead of
+// Token to keep the token out of the file
+type APIToken struct {
+	Name        string `json:"name"`
+	Token       string `json:"token,omitempty"`
+	TokenSHA256 string `json:"tokenSHA256,omitempty"`
+	Role        Role   `json:"role"`
+}
+
+type tokenAuthenticator struct {
+	tokens []*APIToken
+}
+
+func newTokenAuthenticator(tokens []*APIToken) (*tokenAuthenticator, error) {
+	for _, t := range tokens {
+		if _, ok := roleLevels[t.Role]; !ok {
+			return nil, fmt.Errorf("api token %s has invalid role %s", t.Name, t.Role)
+		}
+
+		if len(t.Token) == 0 && len(t.TokenSHA256) == 0 {
+			return nil, fmt.Errorf("api token %s has no token", t.Name)
+		}
+	}
+
+	if len(tokens) == 0 {
+		log.Warn("no api token configured, admin api is disabled")
+	}
+
+	return &tokenAuthenticator{tokens: tokens}, nil
+}
+
+func (ta *tokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) == 0 {
+		return nil, nil
+	}
+
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		return nil, nil
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+	for _, t := range ta.tokens {
+		match := false
+		if len(t.Token) > 0 {
+			match = subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1
+		} else {
+			match = subtle.ConstantTimeCompare([]byte(strings.ToLower(t.TokenSHA256)), []byte(hash)) == 1
+		}
+
+		if match {
+			return &Principal{Name: t.Name, Role: t.Role}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid api token")
+}
+
+type principalKey struct{}
+
+func principalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// authenticate try the authenticators in order
+func (h *CustomHandler) authenticate(r *http.Request) (*Principal, error) {
+	for _, a := range h.authenticators {
+		p, err := a.Authenticate(r)
+		if err != nil || p != nil {
+			return p, err
+		}
+	}
+	return nil, fmt.Errorf("authentication required")
+}
+
+// requireRole wrap admin handler, the principal is put in request context
+func (h *CustomHandler) requireRole(role Role, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := h.authenticate(r)
+		if err != nil {
+			h.auditDenied(r, err.Error())
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			resultError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+		if !p.Role.allows(role) {
+			msg := fmt.Sprintf("%s require role %s", r.URL.Path, role)
+			h.auditDenied(r, msg)
+			resultError(w, http.StatusForbidden, msg)
+			return
+		}
+
+		next(w, r)
+	})
+}
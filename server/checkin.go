@@ -0,0 +1,72 @@
+package server
+
+import (
+	"agent/protocol"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// max size of check in body, both compressed and decompressed
+const maxCheckinBodySize = 1 << 20
+
+// parseCheckin accept the json check in with POST, and the legacy
+// check in with GET which put device info in query string, it also
+// return the raw body for signature verification
+func parseCheckin(r *http.Request) (*protocol.CheckinRequest, []byte, error) {
+	if r.Method == http.MethodGet {
+		checkin, err := checkinFromURLQuery(r.URL.Query())
+		if err != nil {
+			return nil, nil, err
+		}
+		return checkin, nil, checkin.Device.Validate()
+	}
+
+	if r.Method != http.MethodPost {
+		return nil, nil, fmt.Errorf("unsupported method %s", r.Method)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(r.Body, maxCheckinBodySize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(raw) > maxCheckinBodySize {
+		return nil, nil, fmt.Errorf("check in body too large")
+	}
+
+	var body io.Reader = bytes.NewReader(raw)
+	switch r.Header.Get("Content-Encoding") {
+	case "":
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return nil, nil, fmt.Errorf("unsupported content encoding %s", r.Header.Get("Content-Encoding"))
+	}
+
+	// unknown fields are ignored, newer agents add optional fields without
+	// bumping the schema version
+	decoder := json.NewDecoder(io.LimitReader(body, maxCheckinBodySize))
+
+	checkin := &protocol.CheckinRequest{}
+	err = decoder.Decode(checkin)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode check in failed: %s", err.Error())
+	}
+
+	return checkin, raw, checkin.Validate()
+}
+
+func resultJSONError(w http.ResponseWriter, statusCode int, errMsg string) {
+	buf, _ := json.Marshal(&protocol.ErrorResponse{Error: errMsg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(buf)
+}
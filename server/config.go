@@ -8,6 +8,23 @@ import (
 type Config struct {
 	LuaFileList      []*File `json:"luaList"`
 	BusinessFileList []*File `json:"businessList"`
+
+	ManifestList []*DeviceManifest `json:"manifestList"`
+
+	PluginList []*DevicePlugin `json:"pluginList"`
+
+	AgentList []*AgentRelease `json:"agentList"`
+
+	AgentConfigList []*DeviceAgentConfig `json:"agentConfigList"`
+
+	// seconds agents should wait before next check in, raise it to slow down the fleet
+	NextPollSeconds int `json:"nextPollSeconds"`
+
+	// reusable tokens for enrollment, one time tokens are created by api
+	FleetTokens []*FleetToken `json:"enrollTokens"`
+
+	// tokens of admin api
+	APITokens []*APIToken `json:"apiTokens"`
 }
 
 type File struct {
@@ -15,6 +32,78 @@ type File struct {
 	MD5     string `json:"md5"`
 	URL     string `json:"url"`
 	OS      string `json:"os"`
+	// base64 ed25519 signature of the file, required by agents with trusted keys
+	Signature string `json:"signature,omitempty"`
+}
+
+// PluginFile is a named script run beside the main script
+type PluginFile struct {
+	Name string `json:"name"`
+	MD5  string `json:"md5"`
+	URL  string `json:"url"`
+	// base64 ed25519 signature of the file, required by agents with trusted keys
+	Signature string `json:"signature,omitempty"`
+}
+
+// DevicePlugin is sent to the matched devices, empty UUID and OS match
+// all devices. A device get the first match of each plugin name
+type DevicePlugin struct {
+	UUID string `json:"uuid"`
+	OS   string `json:"os"`
+	PluginFile
+}
+
+func (c *Config) findPlugins(d *Device) []*PluginFile {
+	plugins := []*PluginFile{}
+	names := make(map[string]bool)
+	for _, dp := range c.PluginList {
+		if names[dp.Name] || !matchDevice(dp.UUID, dp.OS, d) {
+			continue
+		}
+
+		names[dp.Name] = true
+		plugins = append(plugins, &dp.PluginFile)
+	}
+	return plugins
+}
+
+// DeviceAgentConfig is pushed to agents and saved in their config file,
+// agents only take scriptInterval, heartbeatInterval and log level from it.
+// Empty UUID and OS match all devices
+type DeviceAgentConfig struct {
+	UUID   string          `json:"uuid"`
+	OS     string          `json:"os"`
+	Config json.RawMessage `json:"config"`
+}
+
+func (c *Config) findAgentConfig(d *Device) json.RawMessage {
+	for _, ac := range c.AgentConfigList {
+		if matchDevice(ac.UUID, ac.OS, d) {
+			return ac.Config
+		}
+	}
+	return nil
+}
+
+// AgentRelease is an agent binary build for GOOS/GOARCH
+type AgentRelease struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	MD5     string `json:"md5"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	// base64 ed25519 signature of the binary, agent verify it with the
+	// trusted keys
+	Signature string `json:"signature,omitempty"`
+}
+
+func (c *Config) findAgentRelease(goos, goarch string) *AgentRelease {
+	for _, r := range c.AgentList {
+		if r.OS == goos && r.Arch == goarch {
+			return r
+		}
+	}
+	return nil
 }
 
 func ParseConfig(filePath string) (*Config, error) {
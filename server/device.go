@@ -1,6 +1,9 @@
 package server
 
 import (
+	"agent/protocol"
+	"encoding/json"
+	"fmt"
 	"net/url"
 	"strconv"
 	"time"
@@ -11,6 +14,7 @@ type Device struct {
 	AndroidID           string
 	AndroidSerialNumber string
 
+	HostName        string
 	OS              string
 	Platform        string
 	PlatformVersion string
@@ -28,45 +32,115 @@ type Device struct {
 	Baseboard       string
 
 	LastActivityTime time.Time
+
+	Reports map[string]*Report
+}
+
+// Report is the last payload device posted to /report/{kind}
+type Report struct {
+	Time time.Time
+	Data json.RawMessage
+}
+
+// NewDeviceFromCheckin create device from the check in of agent
+func NewDeviceFromCheckin(checkin *protocol.CheckinRequest) *Device {
+	info := checkin.Device
+	return &Device{
+		UUID:                info.UUID,
+		AndroidID:           info.AndroidID,
+		AndroidSerialNumber: info.AndroidSerialNumber,
+
+		HostName:        info.HostName,
+		OS:              info.OS,
+		Platform:        info.Platform,
+		PlatformVersion: info.PlatformVersion,
+		Arch:            info.Arch,
+		BootTime:        info.BootTime,
+
+		Macs:            info.Macs,
+		CPUModuleName:   info.CPUModuleName,
+		CPUCores:        info.CPUCores,
+		CPUMhz:          info.CPUMhz,
+		TotalMemory:     info.TotalMemory,
+		UsedMemory:      info.UsedMemory,
+		AvailableMemory: info.AvailableMemory,
+		Baseboard:       info.Baseboard,
+
+		LastActivityTime: time.Now(),
+	}
 }
 
-func NewDeviceFromURLQuery(values url.Values) *Device {
-	d := &Device{LastActivityTime: time.Now()}
-	d.UUID = values.Get("uuid")
-	d.AndroidID = values.Get("androidID")
-	d.AndroidSerialNumber = values.Get("androidSerialNumber")
+// checkinFromURLQuery parse the legacy check in which put device info in query string
+func checkinFromURLQuery(values url.Values) (*protocol.CheckinRequest, error) {
+	p := &queryParser{values: values}
+	info := &protocol.DeviceInfo{}
+	info.UUID = values.Get("uuid")
+	info.AndroidID = values.Get("androidID")
+	info.AndroidSerialNumber = values.Get("androidSerialNumber")
+
+	info.HostName = values.Get("hostname")
+	info.OS = values.Get("os")
+	info.Platform = values.Get("platform")
+	info.PlatformVersion = values.Get("platformVersion")
+	info.Arch = values.Get("arch")
+	info.BootTime = p.int64("bootTime")
 
-	d.OS = values.Get("os")
-	d.Platform = values.Get("platform")
-	d.PlatformVersion = values.Get("platformVersion")
-	d.Arch = values.Get("arch")
-	d.BootTime = stringToInt64(values.Get("bootTime"))
+	info.Macs = values.Get("macs")
+	info.CPUModuleName = values.Get("cpuModuleName")
+	info.CPUCores = int(p.int64("cpuCores"))
+	info.CPUMhz = p.float64("cpuMhz")
 
-	d.Macs = values.Get("macs")
-	d.CPUModuleName = values.Get("cpuModuleName")
-	d.CPUCores = stringToInt(values.Get("cpuCores"))
-	d.CPUMhz = stringToFloat64(values.Get("cpuMhz"))
+	info.TotalMemory = p.int64("totalmemory")
+	info.UsedMemory = p.int64("usedMemory")
+	info.AvailableMemory = p.int64("availableMemory")
 
-	d.TotalMemory = stringToInt64(values.Get("totalmemory"))
-	d.UsedMemory = stringToInt64(values.Get("usedMemory"))
-	d.AvailableMemory = stringToInt64(values.Get("availableMemory"))
+	info.Baseboard = values.Get("baseboard")
 
-	d.Baseboard = values.Get("baseboard")
+	if p.err != nil {
+		return nil, p.err
+	}
 
-	return d
+	checkin := &protocol.CheckinRequest{
+		SchemaVersion: protocol.CheckinSchemaVersion,
+		AgentVersion:  values.Get("version"),
+		GOOS:          values.Get("goos"),
+		GOARCH:        values.Get("goarch"),
+		EnrollToken:   values.Get("enrollToken"),
+		PublicKey:     values.Get("publicKey"),
+		Device:        info,
+	}
+
+	return checkin, nil
 }
 
-func stringToInt(v string) int {
-	i, _ := strconv.Atoi(v)
-	return i
+// queryParser keep the first parse error, empty values are parsed as 0
+type queryParser struct {
+	values url.Values
+	err    error
 }
 
-func stringToInt64(v string) int64 {
-	i, _ := strconv.ParseInt(v, 10, 64)
+func (p *queryParser) int64(key string) int64 {
+	v := p.values.Get(key)
+	if len(v) == 0 || p.err != nil {
+		return 0
+	}
+
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		p.err = fmt.Errorf("invalid %s: %s", key, v)
+	}
 	return i
 }
 
-func stringToFloat64(v string) float64 {
-	i, _ := strconv.ParseFloat(v, 64)
-	return i
+func (p *queryParser) float64(key string) float64 {
+	v := p.values.Get(key)
+	if len(v) == 0 || p.err != nil {
+		return 0
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		p.err = fmt.Errorf("invalid %s: %s", key, v)
+	}
+	return f
 }
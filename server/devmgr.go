@@ -13,6 +13,8 @@ const (
 
 type DevMgr struct {
 	devices sync.Map
+	// protect the reports and activity time of devices
+	reportLock sync.Mutex
 }
 
 func newDevMgr(ctx context.Context) *DevMgr {
@@ -37,6 +39,9 @@ func (dm *DevMgr) startTicker(ctx context.Context) {
 }
 
 func (dm *DevMgr) keepalive() {
+	dm.reportLock.Lock()
+	defer dm.reportLock.Unlock()
+
 	offlineDevices := make([]*Device, 0)
 	dm.devices.Range(func(key, value any) bool {
 		d := value.(*Device)
@@ -67,12 +72,24 @@ func (dm *DevMgr) getDevice(uuid string) *Device {
 	return v.(*Device)
 }
 
+// getAll return the copies of devices, they can be marshaled while the
+// reports are updated
 func (dm *DevMgr) getAll() []*Device {
+	dm.reportLock.Lock()
+	defer dm.reportLock.Unlock()
+
 	devices := make([]*Device, 0)
 	dm.devices.Range(func(key, value any) bool {
 		d := value.(*Device)
 		if d != nil {
-			devices = append(devices, d)
+			copied := *d
+			if d.Reports != nil {
+				copied.Reports = make(map[string]*Report, len(d.Reports))
+				for kind, report := range d.Reports {
+					copied.Reports[kind] = report
+				}
+			}
+			devices = append(devices, &copied)
 		}
 		return true
 	})
@@ -91,5 +108,24 @@ func (dm *DevMgr) updateDevice(d *Device) {
 		return
 	}
 
+	dm.reportLock.Lock()
 	device.LastActivityTime = d.LastActivityTime
+	dm.reportLock.Unlock()
+}
+
+func (dm *DevMgr) setReport(uuid string, kind string, data []byte) bool {
+	device := dm.getDevice(uuid)
+	if device == nil {
+		return false
+	}
+
+	dm.reportLock.Lock()
+	defer dm.reportLock.Unlock()
+
+	if device.Reports == nil {
+		device.Reports = make(map[string]*Report)
+	}
+	device.Reports[kind] = &Report{Time: time.Now(), Data: data}
+	device.LastActivityTime = time.Now()
+	return true
 }
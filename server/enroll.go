@@ -0,0 +1,410 @@
+package server
+
+import (
+	"agent/protocol"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const enrollmentFileName = "enrollments.json"
+
+// FleetToken can enroll any number of devices, it is set in config file
+type FleetToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// devices enrolled by the token are approved without operator
+	AutoApprove bool `json:"autoApprove"`
+}
+
+// EnrollToken is a one time token created by operator, only its hash is saved
+type EnrollToken struct {
+	Name       string `json:"name"`
+	Hash       string `json:"hash"`
+	ExpireTime int64  `json:"expireTime"`
+	UsedBy     string `json:"usedBy,omitempty"`
+}
+
+type Enrollment struct {
+	UUID     string `json:"uuid"`
+	HostName string `json:"hostname"`
+	OS       string `json:"os"`
+	Token    string `json:"token"`
+	// base64 ed25519 public key, requests of device must be signed by it
+	PublicKey string `json:"publicKey,omitempty"`
+	// key presented without enrollment token by a device enrolled before
+	// it had a key, it is only shown to operator and never registered, the
+	// device must check in with a valid token to register its key
+	PendingKey string                `json:"pendingKey,omitempty"`
+	Status     protocol.EnrollStatus `json:"status"`
+	Reason     string                `json:"reason,omitempty"`
+
+	CreateTime int64 `json:"createTime"`
+	UpdateTime int64 `json:"updateTime"`
+}
+
+// EnrollMgr keep the enrollments and one time tokens in data dir
+type EnrollMgr struct {
+	lock     sync.Mutex
+	filePath string
+	fleet    []*FleetToken
+
+	Enrollments map[string]*Enrollment  `json:"enrollments"`
+	Tokens      map[string]*EnrollToken `json:"tokens"`
+}
+
+func newEnrollMgr(dataDir string, fleet []*FleetToken) (*EnrollMgr, error) {
+	em := &EnrollMgr{
+		filePath:    path.Join(dataDir, enrollmentFileName),
+		fleet:       fleet,
+		Enrollments: make(map[string]*Enrollment),
+		Tokens:      make(map[string]*EnrollToken),
+	}
+
+	buf, err := os.ReadFile(em.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return em, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(buf, em)
+	if err != nil {
+		return nil, fmt.Errorf("load %s failed:%v", em.filePath, err)
+	}
+
+	return em, nil
+}
+
+// save must be called with lock held
+func (em *EnrollMgr) save() {
+	buf, err := json.MarshalIndent(em, "", "  ")
+	if err != nil {
+		log.Errorf("EnrollMgr marshal failed:%v", err)
+		return
+	}
+
+	tmp := em.filePath + ".tmp"
+	err = os.WriteFile(tmp, buf, 0600)
+	if err == nil {
+		err = os.Rename(tmp, em.filePath)
+	}
+	if err != nil {
+		log.Errorf("EnrollMgr save failed:%v", err)
+	}
+}
+
+// checkin return the enrollment of device, a new device must present a valid
+// token, the public key is registered if the device does not have one
+func (em *EnrollMgr) checkin(d *Device, token string, publicKey string) (*Enrollment, error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	e := em.Enrollments[d.UUID]
+	if e != nil {
+		if len(e.PublicKey) == 0 && len(publicKey) > 0 {
+			em.registerKey(e, token, publicKey)
+		}
+
+		copied := *e
+		return &copied, nil
+	}
+
+	if len(token) == 0 {
+		return nil, fmt.Errorf("device %s not enrolled, enrollment token is required", d.UUID)
+	}
+
+	tokenName, autoApprove, err := em.useToken(d.UUID, token)
+	if err != nil {
+		return nil, err
+	}
+
+	status := protocol.EnrollPending
+	if autoApprove {
+		status = protocol.EnrollApproved
+	}
+
+	now := time.Now().Unix()
+	e = &Enrollment{
+		UUID:       d.UUID,
+		HostName:   d.HostName,
+		OS:         d.OS,
+		Token:      tokenName,
+		PublicKey:  publicKey,
+		Status:     status,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+	em.Enrollments[d.UUID] = e
+	em.save()
+
+	log.Infof("device %s enroll with token %s, status %s", d.UUID, tokenName, status)
+	copied := *e
+	return &copied, nil
+}
+
+// registerKey attach the key to a device enrolled before it had one, anyone
+// knowing the uuid can present a key, so it is attached only with a valid
+// token. The status of device is never changed here. Lock must be held
+func (em *EnrollMgr) registerKey(e *Enrollment, token string, publicKey string) {
+	tokenName, _, err := em.useToken(e.UUID, token)
+	if err != nil {
+		if e.PendingKey == publicKey {
+			return
+		}
+
+		log.Warnf("device %s present public key without valid token, ignore it:%v", e.UUID, err)
+		e.PendingKey = publicKey
+	} else {
+		log.Infof("device %s register public key with token %s", e.UUID, tokenName)
+		e.PublicKey = publicKey
+		e.PendingKey = ""
+		e.Token = tokenName
+	}
+
+	e.UpdateTime = time.Now().Unix()
+	em.save()
+}
+
+// useToken check the fleet token or one time token, the one time token
+// is marked used by the device. Lock must be held
+func (em *EnrollMgr) useToken(uuid string, token string) (name string, autoApprove bool, err error) {
+	if len(token) == 0 {
+		return "", false, fmt.Errorf("enrollment token is required")
+	}
+
+	if fleet := em.findFleetToken(token); fleet != nil {
+		return fleet.Name, fleet.AutoApprove, nil
+	}
+
+	t := em.Tokens[hashToken(token)]
+	if t == nil || len(t.UsedBy) > 0 || time.Now().Unix() > t.ExpireTime {
+		return "", false, fmt.Errorf("invalid enrollment token")
+	}
+	t.UsedBy = uuid
+
+	return t.Name, false, nil
+}
+
+func (em *EnrollMgr) findFleetToken(token string) *FleetToken {
+	for _, t := range em.fleet {
+		if len(t.Token) > 0 && subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return t
+		}
+	}
+	return nil
+}
+
+func (em *EnrollMgr) publicKey(uuid string) string {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	e := em.Enrollments[uuid]
+	if e == nil {
+		return ""
+	}
+	return e.PublicKey
+}
+
+// remove the enrollment, device must enroll again with a new token,
+// e.g. when its key is lost
+func (em *EnrollMgr) remove(uuid string) *Enrollment {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	e := em.Enrollments[uuid]
+	if e == nil {
+		return nil
+	}
+
+	delete(em.Enrollments, uuid)
+	em.save()
+
+	log.Infof("device %s enrollment removed", uuid)
+	return e
+}
+
+func (em *EnrollMgr) isApproved(uuid string) bool {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	e := em.Enrollments[uuid]
+	return e != nil && e.Status == protocol.EnrollApproved
+}
+
+// setStatus return the enrollment before and after change
+func (em *EnrollMgr) setStatus(uuid string, status protocol.EnrollStatus, reason string) (*Enrollment, *Enrollment, error) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	e := em.Enrollments[uuid]
+	if e == nil {
+		return nil, nil, fmt.Errorf("enrollment of device %s not found", uuid)
+	}
+	before := *e
+
+	e.Status = status
+	e.Reason = reason
+	e.UpdateTime = time.Now().Unix()
+	em.save()
+
+	log.Infof("device %s enrollment %s, reason %s", uuid, status, reason)
+	after := *e
+	return &before, &after, nil
+}
+
+func (em *EnrollMgr) list(status protocol.EnrollStatus) []*Enrollment {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	enrollments := make([]*Enrollment, 0, len(em.Enrollments))
+	for _, e := range em.Enrollments {
+		if len(status) == 0 || e.Status == status {
+			copied := *e
+			enrollments = append(enrollments, &copied)
+		}
+	}
+	sort.Slice(enrollments, func(i, j int) bool { return enrollments[i].CreateTime < enrollments[j].CreateTime })
+
+	return enrollments
+}
+
+// createToken return a new one time token, it is only shown once
+func (em *EnrollMgr) createToken(name string, ttl time.Duration) (string, *EnrollToken, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(buf)
+
+	t := &EnrollToken{
+		Name:       name,
+		Hash:       hashToken(token),
+		ExpireTime: time.Now().Add(ttl).Unix(),
+	}
+
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	// drop the expired tokens
+	now := time.Now().Unix()
+	for hash, old := range em.Tokens {
+		if old.ExpireTime < now {
+			delete(em.Tokens, hash)
+		}
+	}
+
+	em.Tokens[t.Hash] = t
+	em.save()
+
+	return token, t, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+const defaultEnrollTokenTTL = 24 * time.Hour
+
+type CreateTokenRequest struct {
+	Name string `json:"name"`
+	// seconds, default 24 hours
+	TTL int `json:"ttl"`
+}
+
+type CreateTokenResponse struct {
+	Token      string `json:"token"`
+	ExpireTime int64  `json:"expireTime"`
+}
+
+func (h *CustomHandler) handleEnrollList(w http.ResponseWriter, r *http.Request) {
+	status := protocol.EnrollStatus(r.URL.Query().Get("status"))
+	resultJSON(w, h.enrollMgr.list(status))
+}
+
+func (h *CustomHandler) handleEnrollStatus(status protocol.EnrollStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			resultError(w, http.StatusMethodNotAllowed, "only support POST")
+			return
+		}
+
+		uuid := r.URL.Query().Get("uuid")
+		before, e, err := h.enrollMgr.setStatus(uuid, status, r.URL.Query().Get("reason"))
+		if err != nil {
+			resultError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		h.audit(r, "enroll."+string(status), []string{uuid}, before, e)
+
+		if status != protocol.EnrollApproved {
+			if d := h.devMgr.getDevice(uuid); d != nil {
+				h.devMgr.removeDevice(d)
+			}
+		}
+
+		resultJSON(w, e)
+	}
+}
+
+func (h *CustomHandler) handleEnrollRemove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		resultError(w, http.StatusMethodNotAllowed, "only support POST")
+		return
+	}
+
+	uuid := r.URL.Query().Get("uuid")
+	before := h.enrollMgr.remove(uuid)
+	if before == nil {
+		resultError(w, http.StatusNotFound, fmt.Sprintf("enrollment of device %s not found", uuid))
+		return
+	}
+	h.audit(r, "enroll.remove", []string{uuid}, before, nil)
+
+	if d := h.devMgr.getDevice(uuid); d != nil {
+		h.devMgr.removeDevice(d)
+	}
+}
+
+func (h *CustomHandler) handleEnrollToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		resultError(w, http.StatusMethodNotAllowed, "only support POST")
+		return
+	}
+
+	req := &CreateTokenRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		resultError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ttl := defaultEnrollTokenTTL
+	if req.TTL > 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+
+	token, t, err := h.enrollMgr.createToken(req.Name, ttl)
+	if err != nil {
+		resultError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// only the hash of token is recorded
+	h.audit(r, "enroll.token.create", []string{"token:" + t.Name}, nil, t)
+
+	resultJSON(w, &CreateTokenResponse{Token: token, ExpireTime: t.ExpireTime})
+}
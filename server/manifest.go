@@ -0,0 +1,66 @@
+package server
+
+// Manifest is the desired state of a device, the agent reconciles to it on every tick
+type Manifest struct {
+	Version   string             `json:"version"`
+	Packages  []*ManifestPackage `json:"packages"`
+	Processes []*ManifestProcess `json:"processes"`
+	Files     []*ManifestFile    `json:"files"`
+}
+
+type ManifestPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	MD5     string `json:"md5"`
+	// base64 ed25519 signature of the package file, required if the
+	// agent has trusted keys
+	Signature string `json:"signature,omitempty"`
+}
+
+type ManifestProcess struct {
+	Name string   `json:"name"`
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+	Env  []string `json:"env"`
+	Dir  string   `json:"dir"`
+}
+
+type ManifestFile struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+	Mode    string `json:"mode"`
+}
+
+// DeviceManifest select the devices a manifest apply to, empty UUID and OS match all devices
+type DeviceManifest struct {
+	UUID     string    `json:"uuid"`
+	OS       string    `json:"os"`
+	Manifest *Manifest `json:"manifest"`
+}
+
+func (dm *DeviceManifest) match(d *Device) bool {
+	return matchDevice(dm.UUID, dm.OS, d)
+}
+
+func matchDevice(uuid, os string, d *Device) bool {
+	if len(uuid) > 0 && uuid != d.UUID {
+		return false
+	}
+
+	if len(os) > 0 && os != d.OS {
+		return false
+	}
+
+	return true
+}
+
+// findManifest return the first manifest which match the device
+func (c *Config) findManifest(d *Device) *Manifest {
+	for _, dm := range c.ManifestList {
+		if dm.match(d) {
+			return dm.Manifest
+		}
+	}
+	return nil
+}
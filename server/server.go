@@ -1,26 +1,78 @@
 package server
 
 import (
+	"agent/protocol"
 	"context"
+	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
 )
 
+// reports are read before the signature is checked, so they are limited
+const maxReportBodySize = 1 << 20
+
 // Define a custom multiplexer type
 type CustomServeMux struct {
-	routes map[string]http.Handler
+	routes  map[string]http.Handler
+	handler *CustomHandler
 }
 
-func NewCustomServerMux(config *Config) *CustomServeMux {
-	handler := CustomHandler{config: config, devMgr: newDevMgr(context.Background())}
+func NewCustomServerMux(config *Config, dataDir string) (*CustomServeMux, error) {
+	enrollMgr, err := newEnrollMgr(dataDir, config.FleetTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenAuth, err := newTokenAuthenticator(config.APITokens)
+	if err != nil {
+		return nil, err
+	}
+
+	auditLog, err := newAuditLog(dataDir)
+	if err != nil {
+		return nil, err
+	}
 
-	mux := &CustomServeMux{routes: make(map[string]http.Handler)}
+	handler := &CustomHandler{
+		config:         config,
+		devMgr:         newDevMgr(context.Background()),
+		enrollMgr:      enrollMgr,
+		nonces:         newNonceCache(),
+		authenticators: []Authenticator{tokenAuth},
+		auditLog:       auditLog,
+	}
+
+	mux := &CustomServeMux{routes: make(map[string]http.Handler), handler: handler}
+
+	// agent endpoints, authenticated by device signature
 	mux.Handle("/update/lua", http.HandlerFunc(handler.handleLuaUpdate))
 	mux.Handle("/update/business", http.HandlerFunc(handler.handleBusinessUpdate))
-	mux.Handle("/device/list", http.HandlerFunc(handler.handleDeviceList))
+	mux.Handle("/report/reconcile", handler.handleReport("reconcile"))
+	mux.Handle("/report/crash", handler.handleReport("crash"))
+	mux.Handle("/report/heartbeat", handler.handleReport("heartbeat"))
+	mux.Handle("/report/script", handler.handleReport("script"))
+	mux.Handle("/report/plugins", handler.handleReport("plugins"))
+	mux.Handle("/report/update", handler.handleReport("update"))
+
+	// admin endpoints, authenticated by api token
+	mux.Handle("/admin/device/list", handler.requireRole(RoleViewer, handler.handleDeviceList))
+	mux.Handle("/admin/enroll/list", handler.requireRole(RoleViewer, handler.handleEnrollList))
+	mux.Handle("/admin/enroll/approve", handler.requireRole(RoleOperator, handler.handleEnrollStatus(protocol.EnrollApproved)))
+	mux.Handle("/admin/enroll/reject", handler.requireRole(RoleOperator, handler.handleEnrollStatus(protocol.EnrollRejected)))
+	mux.Handle("/admin/enroll/remove", handler.requireRole(RoleAdmin, handler.handleEnrollRemove))
+	mux.Handle("/admin/enroll/token", handler.requireRole(RoleAdmin, handler.handleEnrollToken))
+	mux.Handle("/admin/audit", handler.requireRole(RoleAdmin, handler.handleAuditQuery))
+	mux.Handle("/admin/audit/verify", handler.requireRole(RoleAdmin, handler.handleAuditVerify))
 
-	return mux
+	return mux, nil
 }
 
 // Implement the ServeHTTP method for CustomServeMux
@@ -28,6 +80,8 @@ func (mux *CustomServeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	handler, found := mux.routes[r.URL.Path]
 	if found {
 		handler.ServeHTTP(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/admin/") {
+		http.NotFound(w, r)
 	} else {
 		http.DefaultServeMux.ServeHTTP(w, r)
 		// http.NotFound(w, r)
@@ -39,21 +93,185 @@ func (mux *CustomServeMux) Handle(pattern string, handler http.Handler) {
 	mux.routes[pattern] = handler
 }
 
+// FileServer serve files in dir without directory listing, the download
+// must come from an approved device or carry a viewer api token. The
+// hidden paths such as config file and data dir are never served
+func (mux *CustomServeMux) FileServer(dir string, hidden ...string) http.Handler {
+	nfs := noDirFileSystem{fs: http.Dir(dir), dir: dir}
+	for _, p := range hidden {
+		nfs.hidden = append(nfs.hidden, realPath(p))
+	}
+	fileServer := http.FileServer(nfs)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uuid := r.Header.Get(protocol.HeaderDeviceID)
+		if len(uuid) > 0 {
+			err := mux.handler.verifyDownload(r, uuid)
+			if err != nil {
+				resultError(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+
+		mux.handler.requireRole(RoleViewer, fileServer.ServeHTTP).ServeHTTP(w, r)
+	})
+}
+
+// noDirFileSystem hide the directories so file server can not list them
+type noDirFileSystem struct {
+	fs  http.FileSystem
+	dir string
+	// absolute paths of the files and dirs never served
+	hidden []string
+}
+
+// isHidden return true if name is one of the hidden paths or in them, the
+// symlinks are resolved so they can not point to hidden files
+func (nfs noDirFileSystem) isHidden(name string) bool {
+	target := realPath(filepath.Join(nfs.dir, filepath.FromSlash(path.Clean("/"+name))))
+	for _, h := range nfs.hidden {
+		if target == h || strings.HasPrefix(target, h+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// realPath return the absolute path with symlinks resolved, the missing
+// part of the path is kept as it is
+func realPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return filepath.Clean(p)
+	}
+
+	dir, rest := abs, ""
+	for {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(real, rest)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return abs
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = parent
+	}
+}
+
+func (nfs noDirFileSystem) Open(name string) (http.File, error) {
+	if nfs.isHidden(name) {
+		return nil, os.ErrNotExist
+	}
+
+	f, err := nfs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+
+	return f, nil
+}
+
+type UpdateResponse struct {
+	*File
+	Plugins  []*PluginFile   `json:"plugins,omitempty"`
+	Manifest *Manifest       `json:"manifest,omitempty"`
+	Agent    *AgentRelease   `json:"agent,omitempty"`
+	Config   json.RawMessage `json:"config,omitempty"`
+
+	Enrollment *protocol.Enrollment `json:"enrollment,omitempty"`
+
+	NextPollSeconds int `json:"nextPollSeconds,omitempty"`
+}
+
 type CustomHandler struct {
 	// luaDir string
-	config *Config
-	devMgr *DevMgr
+	config    *Config
+	devMgr    *DevMgr
+	enrollMgr *EnrollMgr
+	nonces    *nonceCache
+
+	authenticators []Authenticator
+	auditLog       *AuditLog
+}
+
+// verifyDevice check the signature if device has registered a public key
+func (h *CustomHandler) verifyDevice(r *http.Request, uuid string, body []byte) error {
+	publicKey := h.enrollMgr.publicKey(uuid)
+	if len(publicKey) == 0 {
+		return nil
+	}
+	return h.nonces.verifySignature(r, uuid, publicKey, body)
+}
+
+// verifyDownload require the device is approved and signed the request,
+// the approved device without key on file is allowed until it register
+// one, so the devices enrolled before signing keep working
+func (h *CustomHandler) verifyDownload(r *http.Request, uuid string) error {
+	if !h.enrollMgr.isApproved(uuid) {
+		return fmt.Errorf("device %s not approved", uuid)
+	}
+
+	publicKey := h.enrollMgr.publicKey(uuid)
+	if len(publicKey) == 0 {
+		log.Warnf("device %s has no public key, download is not verified", uuid)
+		return nil
+	}
+
+	return h.nonces.verifySignature(r, uuid, publicKey, nil)
 }
 
 func (h *CustomHandler) handleLuaUpdate(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("handleLuaUpdate, queryString %s\n", r.URL.RawQuery)
+	checkin, body, err := parseCheckin(r)
+	if err != nil {
+		resultJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	d := NewDeviceFromCheckin(checkin)
+	version := checkin.AgentVersion
+	log.Infof("handleLuaUpdate uuid %s, version %s, method %s", d.UUID, version, r.Method)
 
-	d := NewDeviceFromURLQuery(r.URL.Query())
-	if d != nil {
-		h.devMgr.updateDevice(d)
+	// verify with the registered key, or the presented key before it is registered
+	publicKey := h.enrollMgr.publicKey(d.UUID)
+	if len(publicKey) == 0 {
+		publicKey = checkin.PublicKey
 	}
 
-	version := r.URL.Query().Get("version")
+	if len(publicKey) > 0 {
+		err = h.nonces.verifySignature(r, d.UUID, publicKey, body)
+		if err != nil {
+			log.Warnf("device %s check in signature invalid:%v", d.UUID, err)
+			resultJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	enrollment, err := h.enrollMgr.checkin(d, checkin.EnrollToken, checkin.PublicKey)
+	if err != nil {
+		// the device without token is only waiting for enrollment
+		if len(checkin.EnrollToken) > 0 {
+			h.audit(r, "enroll.denied", []string{d.UUID}, nil, map[string]string{"reason": err.Error()})
+		}
+		resultJSONError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	enrollRsp := &protocol.Enrollment{Status: enrollment.Status, Reason: enrollment.Reason}
+	if enrollment.Status != protocol.EnrollApproved {
+		resultJSON(w, &UpdateResponse{Enrollment: enrollRsp, NextPollSeconds: h.config.NextPollSeconds})
+		return
+	}
+
+	h.devMgr.updateDevice(d)
 
 	var file *File = nil
 	for _, f := range h.config.LuaFileList {
@@ -63,22 +281,51 @@ func (h *CustomHandler) handleLuaUpdate(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	if file == nil {
-		resultError(w, http.StatusBadRequest, fmt.Sprintf("can not find the version %s script", version))
+	rsp := &UpdateResponse{
+		File:            file,
+		Plugins:         h.config.findPlugins(d),
+		Manifest:        h.config.findManifest(d),
+		Config:          h.config.findAgentConfig(d),
+		Enrollment:      enrollRsp,
+		NextPollSeconds: h.config.NextPollSeconds,
+	}
+	release := h.config.findAgentRelease(checkin.GOOS, checkin.GOARCH)
+	if release != nil && release.Version != version {
+		rsp.Agent = release
+	}
+
+	if rsp.File == nil && len(rsp.Plugins) == 0 && rsp.Manifest == nil && rsp.Agent == nil && rsp.Config == nil {
+		resultJSONError(w, http.StatusBadRequest, fmt.Sprintf("can not find the version %s script", version))
 		return
 	}
 
-	buf, err := json.Marshal(file)
+	buf, err := json.Marshal(rsp)
 	if err != nil {
-		resultError(w, http.StatusBadRequest, err.Error())
+		resultJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	etag := fmt.Sprintf("\"%x\"", md5.Sum(buf))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	w.Write(buf)
 }
 
+// handleBusinessUpdate return the package of version and os, only to the
+// approved devices as the scripts
 func (h *CustomHandler) handleBusinessUpdate(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("handleBusinessUpdate, queryString %s\n", r.URL.RawQuery)
+	log.Infof("handleBusinessUpdate, queryString %s", r.URL.RawQuery)
+
+	uuid := r.Header.Get(protocol.HeaderDeviceID)
+	err := h.verifyDownload(r, uuid)
+	if err != nil {
+		resultError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
 
 	version := r.URL.Query().Get("version")
 	os := r.URL.Query().Get("os")
@@ -116,6 +363,59 @@ func (h *CustomHandler) handleDeviceList(w http.ResponseWriter, r *http.Request)
 	w.Write(buf)
 }
 
+func (h *CustomHandler) handleReport(kind string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			resultError(w, http.StatusMethodNotAllowed, "only support POST")
+			return
+		}
+
+		uuid := r.URL.Query().Get("uuid")
+		if !h.enrollMgr.isApproved(uuid) {
+			resultError(w, http.StatusForbidden, fmt.Sprintf("device %s not approved", uuid))
+			return
+		}
+
+		buf, err := io.ReadAll(io.LimitReader(r.Body, maxReportBodySize+1))
+		if err != nil {
+			resultError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if len(buf) > maxReportBodySize {
+			resultError(w, http.StatusRequestEntityTooLarge, "report body too large")
+			return
+		}
+
+		if !json.Valid(buf) {
+			resultError(w, http.StatusBadRequest, "report body is not json")
+			return
+		}
+
+		err = h.verifyDevice(r, uuid, buf)
+		if err != nil {
+			resultError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		if !h.devMgr.setReport(uuid, kind, buf) {
+			resultError(w, http.StatusNotFound, fmt.Sprintf("device %s not found", uuid))
+			return
+		}
+	})
+}
+
+func resultJSON(w http.ResponseWriter, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		resultError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
 func resultError(w http.ResponseWriter, statusCode int, errMsg string) {
 	w.WriteHeader(statusCode)
 	w.Write([]byte(errMsg))
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"agent/protocol"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// nonceCache remember the nonces in the signature window to reject replay
+type nonceCache struct {
+	lock        sync.Mutex
+	nonces      map[string]time.Time
+	lastCleanup time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{nonces: make(map[string]time.Time)}
+}
+
+// add return false if the nonce is already used
+func (nc *nonceCache) add(nonce string) bool {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(nc.lastCleanup) > time.Minute {
+		for n, t := range nc.nonces {
+			if now.Sub(t) > 2*protocol.SignatureMaxSkew {
+				delete(nc.nonces, n)
+			}
+		}
+		nc.lastCleanup = now
+	}
+
+	if _, ok := nc.nonces[nonce]; ok {
+		return false
+	}
+
+	nc.nonces[nonce] = now
+	return true
+}
+
+// verifySignature check the request is signed by the key of device uuid
+func (nc *nonceCache) verifySignature(r *http.Request, uuid string, publicKey string, body []byte) error {
+	deviceID := r.Header.Get(protocol.HeaderDeviceID)
+	timestamp := r.Header.Get(protocol.HeaderTimestamp)
+	nonce := r.Header.Get(protocol.HeaderNonce)
+	signature := r.Header.Get(protocol.HeaderSignature)
+
+	if len(signature) == 0 {
+		return fmt.Errorf("request not signed")
+	}
+
+	if deviceID != uuid {
+		return fmt.Errorf("device id %s not match %s", deviceID, uuid)
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %s", timestamp)
+	}
+
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > protocol.SignatureMaxSkew || skew < -protocol.SignatureMaxSkew {
+		return fmt.Errorf("timestamp %s out of range", timestamp)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key of device %s", uuid)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature")
+	}
+
+	s := protocol.SigningString(r.Method, r.Host, r.URL.RequestURI(), deviceID, timestamp, nonce, protocol.BodyHash(body))
+	if !ed25519.Verify(ed25519.PublicKey(key), []byte(s), sig) {
+		return fmt.Errorf("signature not match")
+	}
+
+	if len(nonce) == 0 || !nc.add(deviceID+":"+nonce) {
+		return fmt.Errorf("nonce %s already used", nonce)
+	}
+
+	return nil
+}
@@ -10,18 +10,11 @@ function mod.start()
 
     mod.loadLocal()
 
-
-    local checkUpdate = function(isUpdating)
-        if not isUpdating then
-            mod.isUpdate = false
-            mod.startBusinessJob()
-        end
-    end
-
-    mod.isUpdate = true
-    mod.updateFromServer(checkUpdate)
-
-    -- mod.startBusinessJob()
+    local agent = require("agent")
+    agent.async(function()
+        mod.update()
+        mod.startBusinessJob()
+    end)
 
     mod.startTimer()
 
@@ -195,103 +188,76 @@ function mod.onTimerUpdate()
         return
     end
 
-    
-    local checkUpdate = function(isUpdating)
-        if not isUpdating then
-            mod.isUpdate = false
+    local agent = require("agent")
+    agent.async(function()
+        if mod.update() then
+            mod.restartBusinessJob()
         end
-    end
+    end)
+end
 
+-- run in agent.async, return true if business process is updated
+function mod.update()
+    local agent = require("agent")
     mod.isUpdate = true
-    mod.updateFromServer(checkUpdate)
+    local ok, result = agent.pcall(mod.updateFromServer)
+    mod.isUpdate = false
+    if not ok then
+        print("mod.updateFromServer "..tostring(result))
+        return false
+    end
+
+    return result
 end
 
-function mod.updateFromServer(callback)
+-- download, verify and extract the business package
+function mod.updateFromServer()
     local result, err = mod.getURLAndMD5()
     if err then
-        print("mod.updateFromServer get url and md5 from server "..err)
-        callback(false)
-        return
+        error("get url and md5 from server "..err)
     end
 
     if mod.process and mod.process.md5 == result.md5 then
         print("mod.updateFromServer process already update")
-        callback(false)
-        return
+        return false
     end
 
-    mod.updateFileMD5 = result.md5 
-
     local filePath = mod.info.wdir.."/"..mod.downloadPackageName
     local dmod = require 'downloader'
-    dmod.createDownloader("update", filePath, result.url, 10, 'onDownloadCallback')
-    print("create downloader")
-    callback(true)
-end
-
-function mod.getURLAndMD5() 
-    local http = require("http")
-    local client = http.client({timeout= 10})
+    local download = dmod.fetch(filePath, result.url, 10)
+    print("download")
+    mod.printTable(download)
 
-    local url = mod.serverURL.."?version="..mod.info.version
-    local request = http.request("GET", url)
-    local result, err = client:do_request(request)
-    if err then
-        return nil, err
+    if download.md5 ~= result.md5 then
+        error("download update file md5 not match")
     end
 
-    if not (result.code == 200) then
-        return nil, "status code "..result.code
-    end
-
-    local json = require("json")
-    local result, err = json.decode(result.body)
-    if err then
-        return nil, err
-    end
-
-    return result, nil
+    mod.updateProcess(download)
+    print("process")
+    mod.printTable(mod.process)
+    return true
 end
 
+-- run in agent.async, httpc.fetch does not block the timers
+function mod.getURLAndMD5()
+    local httpc = require("httpc")
 
--- unzip file
--- move file to A or B
--- update mod.process
--- restart businessJob
-function mod.onDownloadCallback(result)
-    local agmod = require("downloader")
-    agmod.deleteDownloader("update")
-
-    print("onDownloadCallback")
-
-    mod.printTable(result)
-
-    if not result then
-        mod.isUpdate = false
-        print("result == nil")
-        return
-    end
+    local url = mod.serverURL.."?version="..mod.info.version
+    local resp = httpc.fetch({url = url, timeout = 10})
 
-    if result.err ~= "" then
-        mod.isUpdate = false
-        print(result.err)
-        return
+    if not (resp.status == 200) then
+        return nil, "status code "..resp.status
     end
 
-    if result.md5 ~= mod.updateFileMD5 then
-        print("download update file md5 not match")
-        mod.isUpdate = false
-        return
+    if not resp.json then
+        return nil, "invalid response "..resp.body
     end
 
-    mod.updateProcess(result)
-    print("process")
-    mod.printTable(mod.process)
-    mod.restartBusinessJob()
-
-    mod.isUpdate = false
+    return resp.json, nil
 end
 
+
+-- unzip file, move it to A or B and update mod.process
 function mod.updateProcess(downloadResult)
     local agmod = require("agent")
     local goos = require("goos")